@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Where computed columns that aren't persisted go
+const (
+	ComputedGenerated = "generated" // A stored generated column, like persisted ones
+	ComputedView      = "view"      // A column of the table's _computed view
+)
+
+// A computed column. It's left out of the copy, Postgres works it out from
+// the translated expression instead.
+type ComputedColumn struct {
+	Column
+	Definition string // The T-SQL expression
+	Expression string // The expression in Postgres
+	InView     bool   // In the _computed view rather than generated
+}
+
+type computedDef struct {
+	definition    string
+	persisted     bool
+	deterministic bool
+}
+
+// Functions deterministic expressions can translate into that Postgres won't
+// have in a generated column, as their results depend on settings
+var mutableFunctions = []string{"to_char", "to_timestamp"}
+
+// Read the definitions of a table's computed columns, keyed by lower case
+// column name
+func getComputedColumns(table Table, db *sql.DB) map[string]computedDef {
+	rows, err := db.Query(`SELECT c.name, c.definition, c.is_persisted,
+			COLUMNPROPERTY(c.object_id, c.name, 'IsDeterministic')
+		FROM sys.computed_columns c
+		WHERE c.object_id = OBJECT_ID(?)`, table.MSSqlName())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := map[string]computedDef{}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var def computedDef
+		var deterministic sql.NullInt64
+		if err := rows.Scan(&name, &def.definition, &def.persisted, &deterministic); err != nil {
+			log.Fatal(err)
+		}
+		def.deterministic = deterministic.Int64 == 1
+		out[strings.ToLower(name)] = def
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// Move the computed columns out of the columns that are copied. Persisted
+// ones become generated columns, the others go where mode says. Ones that
+// can't be generated go in the view, unless they're part of a key or index.
+// Those, ones using another computed column Postgres can't see from where
+// they'd be, and ones whose expression can't be translated are copied like
+// any other column.
+func setComputed(t *Table, defs map[string]computedDef, mode string) {
+	if len(defs) == 0 {
+		return
+	}
+	pk := []string{}
+	for _, c := range t.PrimaryKey {
+		pk = append(pk, c.OriginalName)
+	}
+	keys := t.keyColumns()
+
+	computed := map[string]*ComputedColumn{}
+	order := []string{}
+	for _, c := range t.Columns {
+		name := strings.ToLower(c.OriginalName)
+		def, ok := defs[name]
+		if !ok {
+			continue
+		}
+		expr, err := TranslateExpr(unwrapParens(strings.TrimSpace(def.definition)), t)
+		if err != nil {
+			log.Printf("Warning: computed column %s.%s: %s, copying its values instead", t.Key(), c.OriginalName, err)
+			continue
+		}
+		cc := &ComputedColumn{Column: c, Definition: def.definition, Expression: expr}
+		cc.InView = !def.persisted && mode == ComputedView
+		if !cc.InView && !def.deterministic {
+			log.Printf("Warning: computed column %s.%s isn't deterministic, adding it to %s instead", t.Key(), c.OriginalName, t.ComputedViewName())
+			cc.InView = true
+		}
+		for _, f := range mutableFunctions {
+			if !cc.InView && strings.Contains(strings.ToLower(expr), f+"(") {
+				log.Printf("Warning: computed column %s.%s uses %s, which Postgres won't generate a column with, adding it to %s instead", t.Key(), c.OriginalName, f, t.ComputedViewName())
+				cc.InView = true
+			}
+		}
+		if cc.InView && keys[name] {
+			log.Printf("Warning: computed column %s.%s is part of a key or index, so can't be in %s, copying its values instead", t.Key(), c.OriginalName, t.ComputedViewName())
+			continue
+		}
+		computed[name] = cc
+		order = append(order, name)
+	}
+
+	// A generated column can't use another generated column, and the view
+	// only sees the table's columns, so only view columns can use generated
+	// ones
+	copied := []string{}
+	for _, name := range order {
+		cc := computed[name]
+		for _, other := range order {
+			o := computed[other]
+			if other != name && !(cc.InView && !o.InView) && strings.Contains(cc.Expression, o.PsqlName()) {
+				log.Printf("Warning: computed column %s.%s uses computed column %s, copying its values instead", t.Key(), cc.OriginalName, o.OriginalName)
+				copied = append(copied, name)
+				break
+			}
+		}
+	}
+	for _, name := range copied {
+		delete(computed, name)
+	}
+
+	cols := []Column{}
+	for _, c := range t.Columns {
+		if cc, ok := computed[strings.ToLower(c.OriginalName)]; ok {
+			t.Computed = append(t.Computed, *cc)
+		} else {
+			cols = append(cols, c)
+		}
+	}
+	t.Columns = cols
+
+	t.PrimaryKey = nil
+	for _, name := range pk {
+		t.PrimaryKey = append(t.PrimaryKey, t.Column(name))
+	}
+}
+
+// The columns in the primary key, an index or a foreign key, by lower case
+// name
+func (t *Table) keyColumns() map[string]bool {
+	keys := map[string]bool{}
+	for _, c := range t.PrimaryKey {
+		keys[strings.ToLower(c.OriginalName)] = true
+	}
+	for _, idx := range t.Indexes {
+		for _, c := range idx.Columns {
+			keys[strings.ToLower(c.Name)] = true
+		}
+		for _, c := range idx.Include {
+			keys[strings.ToLower(c)] = true
+		}
+	}
+	for _, fk := range t.ForeignKeys {
+		for _, c := range fk.Columns {
+			keys[strings.ToLower(c)] = true
+		}
+	}
+	return keys
+}
+
+// Build the generated column definition for use in a create statement
+func (c *ComputedColumn) CreateSql() (string, error) {
+	typ, err := c.PostgresType()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s GENERATED ALWAYS AS (%s) STORED", c.PsqlName(), typ, c.Expression), nil
+}
+
+func (t *Table) ComputedViewName() string {
+	return t.NewName + "_computed"
+}
+
+// Generate the view adding the computed columns that aren't generated to
+// the table, or an empty string if there aren't any
+func (t *Table) ComputedViewSql() string {
+	cols := []string{}
+	for _, c := range t.Computed {
+		if c.InView {
+			cols = append(cols, fmt.Sprintf("(%s) AS %s", c.Expression, c.PsqlName()))
+		}
+	}
+	if len(cols) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("CREATE OR REPLACE VIEW %s.%s AS\nSELECT *, %s FROM %s",
+		quotePsql(t.NewSchema), quotePsql(t.ComputedViewName()), strings.Join(cols, ", "), t.PsqlName())
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Options for a single table, from the --name-map file or the "overrides"
+// section of a --config file, eg:
+//
+//	{"dbo.Orders": {
+//		"name": "orders",
+//		"columns": {"OrderID": "id"},
+//		"indexes": {"IX_CreatedDate": "orders_created_idx"},
+//		"constraints": {"CK_Orders_Total": "orders_total_check"},
+//		"types": {"Details": "jsonb"},
+//		"transforms": {"Shipped": "yn_bool", "Notes": ["trim", "empty_null"]},
+//		"where": "OrderDate >= '2020-01-01'",
+//		"exclude_columns": ["InternalNotes"]
+//	}}
+type TableOptions struct {
+	Name        string                   `json:"name"`
+	Columns     map[string]string        `json:"columns"`     // New column names
+	Indexes     map[string]string        `json:"indexes"`     // New index and unique constraint names
+	Constraints map[string]string        `json:"constraints"` // New check and foreign key names
+	Types       map[string]string        `json:"types"`
+	Transforms  map[string]transformList `json:"transforms"`
+
+	Where          string   `json:"where"`
+	Sample         string   `json:"sample"`
+	Top            int64    `json:"top"`
+	IncludeColumns []string `json:"include_columns"`
+	ExcludeColumns []string `json:"exclude_columns"`
+
+	SyncColumn string `json:"sync_column"`
+}
+
+// Parse per table options keyed by table name, returning them keyed by lower
+// case schema.table. Tables without a schema are taken to be in defaultSchema.
+func parseTableOptions(data []byte, defaultSchema string) (map[string]TableOptions, error) {
+	raw := map[string]TableOptions{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	out := map[string]TableOptions{}
+	for key, o := range raw {
+		name, err := parseTableName(key, defaultSchema)
+		if err != nil {
+			return nil, err
+		}
+		o.Columns = lowerKeys(o.Columns)
+		o.Indexes = lowerKeys(o.Indexes)
+		o.Constraints = lowerKeys(o.Constraints)
+		o.Types = lowerKeys(o.Types)
+		transforms := map[string]transformList{}
+		for c, list := range o.Transforms {
+			if err := checkTransforms(list); err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", name, c, err)
+			}
+			transforms[strings.ToLower(c)] = list
+		}
+		o.Transforms = transforms
+		if err := checkSample(o.Sample); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		out[strings.ToLower(name.String())] = o
+	}
+	return out, nil
+}
+
+// Column names are matched case insensitively, like in SQL Server
+func lowerKeys(m map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// Options from b replace those from a
+func mergeTableOptions(a, b TableOptions) TableOptions {
+	if b.Name != "" {
+		a.Name = b.Name
+	}
+	if a.Columns == nil {
+		a.Columns = map[string]string{}
+	}
+	for c, newName := range b.Columns {
+		a.Columns[c] = newName
+	}
+	if a.Indexes == nil {
+		a.Indexes = map[string]string{}
+	}
+	for ix, newName := range b.Indexes {
+		a.Indexes[ix] = newName
+	}
+	if a.Constraints == nil {
+		a.Constraints = map[string]string{}
+	}
+	for con, newName := range b.Constraints {
+		a.Constraints[con] = newName
+	}
+	if a.Types == nil {
+		a.Types = map[string]string{}
+	}
+	for c, typ := range b.Types {
+		a.Types[c] = typ
+	}
+	if a.Transforms == nil {
+		a.Transforms = map[string]transformList{}
+	}
+	for c, list := range b.Transforms {
+		a.Transforms[c] = list
+	}
+	if b.Where != "" {
+		a.Where = b.Where
+	}
+	if b.Sample != "" {
+		a.Sample = b.Sample
+	}
+	if b.Top > 0 {
+		a.Top = b.Top
+	}
+	if len(b.IncludeColumns) > 0 {
+		a.IncludeColumns = b.IncludeColumns
+	}
+	if len(b.ExcludeColumns) > 0 {
+		a.ExcludeColumns = b.ExcludeColumns
+	}
+	if b.SyncColumn != "" {
+		a.SyncColumn = b.SyncColumn
+	}
+	return a
+}
+
+func readTableOptions(path, defaultSchema string) (map[string]TableOptions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseTableOptions(data, defaultSchema)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return opts, nil
+}
+
+// The parts of a --config file that aren't options. Everything else in the
+// file is named after the command line option it stands in for.
+type configFile struct {
+	from      string
+	to        string
+	tables    []string
+	overrides json.RawMessage
+}
+
+var envVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// Replace ${NAME} with the environment variable NAME, which must be set
+func expandEnv(s string) (string, error) {
+	var missing []string
+	out := envVar.ReplaceAllStringFunc(s, func(m string) string {
+		name := envVar.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// Read a --config file, setting every option that wasn't given on the
+// command line from it. Files ending in .yaml or .yml are YAML, anything else
+// is JSON.
+func loadConfigFile(path string, flags *flag.FlagSet) (configFile, error) {
+	cf := configFile{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cf, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJson(data); err != nil {
+			return cf, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return cf, fmt.Errorf("%s: %s", path, err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var v interface{}
+		if err := json.Unmarshal(raw[key], &v); err != nil {
+			return cf, fmt.Errorf("%s: %s: %s", path, key, err)
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return cf, fmt.Errorf("%s: %s: %s", path, key, err)
+		}
+
+		switch key {
+		case "from":
+			cf.from = s
+		case "to":
+			cf.to = s
+		case "tables":
+			if s == "" {
+				continue
+			}
+			if cf.tables, err = csv.NewReader(strings.NewReader(s)).Read(); err != nil {
+				return cf, fmt.Errorf("%s: %s: %s", path, key, err)
+			}
+		case "overrides":
+			cf.overrides = raw[key]
+		case "config":
+			return cf, fmt.Errorf("%s: config files can't include other config files", path)
+		default:
+			f := flags.Lookup(key)
+			if f == nil {
+				return cf, fmt.Errorf("%s: unknown option %q", path, key)
+			}
+			if f.Changed {
+				continue
+			}
+			if err := flags.Set(key, s); err != nil {
+				return cf, fmt.Errorf("%s: %s: %s", path, key, err)
+			}
+		}
+	}
+	return cf, nil
+}
+
+// Rewrite a YAML document as JSON, so YAML config files are read exactly like
+// JSON ones, overrides included
+func yamlToJson(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValues(v))
+}
+
+// The YAML parser gives mappings as map[interface{}]interface{}, which JSON
+// can't encode
+func jsonValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range v {
+			out[fmt.Sprint(k)] = jsonValues(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = jsonValues(e)
+		}
+		return out
+	}
+	return v
+}
+
+// Turn a value from a config file into the text it would have on the command
+// line. Lists become comma separated and objects src=dst pairs, so "include"
+// and "schema-map" can be written naturally.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v)
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return csvLine(parts), nil
+	case map[string]interface{}:
+		parts := []string{}
+		for k, e := range v {
+			s, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, k+"="+s)
+		}
+		sort.Strings(parts)
+		return csvLine(parts), nil
+	}
+	return "", fmt.Errorf("unexpected value %v", v)
+}
+
+func csvLine(parts []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(parts)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Check the configuration against the source database without changing
+// anything: every table named exists, every pattern matches a table, the
+// overrides refer to real tables and columns, row filters run, every column
+// type can be translated and the new names don't clash.
+func validateConfig(cfg config, msDB *sql.DB) []string {
+	problems := []string{}
+
+	schemaTables := discoverTables(msDB, cfg.schema)
+	for _, p := range append(append([]string{}, cfg.include...), cfg.exclude...) {
+		if !matchesAnyTable(p, schemaTables) {
+			problems = append(problems, fmt.Sprintf("pattern %s doesn't match any table in %s", p, cfg.schema))
+		}
+	}
+
+	tables := describeTables(cfg, msDB)
+	described := map[string]*Table{}
+	for i := range tables {
+		t := &tables[i]
+		described[strings.ToLower(t.OriginalSchema+"."+t.OriginalName)] = t
+		if _, err := t.CreateSql(); err != nil {
+			problems = append(problems, fmt.Sprintf("table %s: %s", t.Key(), err))
+		}
+	}
+	for _, name := range cfg.tables {
+		n, err := parseTableName(name, cfg.schema)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if described[strings.ToLower(n.String())] == nil && len(filterTables([]tableName{n}, cfg.include, cfg.exclude)) > 0 {
+			problems = append(problems, fmt.Sprintf("table %s doesn't exist", n))
+		}
+	}
+
+	for key, o := range cfg.tableOptions {
+		t := described[key]
+		if t == nil {
+			problems = append(problems, fmt.Sprintf("overrides for %s, which isn't being migrated", key))
+			continue
+		}
+		cols := []string{}
+		for col := range o.Columns {
+			cols = append(cols, col)
+		}
+		for col := range o.Types {
+			cols = append(cols, col)
+		}
+		for col := range o.Transforms {
+			cols = append(cols, col)
+		}
+		cols = append(cols, o.IncludeColumns...)
+		cols = append(cols, o.ExcludeColumns...)
+		if o.SyncColumn != "" {
+			cols = append(cols, o.SyncColumn)
+		}
+		// The table's columns may have been cut down already
+		all := Table{OriginalSchema: t.OriginalSchema, OriginalName: t.OriginalName}
+		all.Columns = getColumns(all, msDB)
+		for _, col := range cols {
+			if all.Column(col) == nil {
+				problems = append(problems, fmt.Sprintf("overrides for %s.%s, which doesn't exist", key, col))
+			}
+		}
+
+		for ix := range o.Indexes {
+			found := false
+			for _, i := range t.Indexes {
+				found = found || strings.EqualFold(i.Name, ix)
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("overrides for index %s on %s, which doesn't exist", ix, key))
+			}
+		}
+		for con := range o.Constraints {
+			found := false
+			for _, fk := range t.ForeignKeys {
+				found = found || strings.EqualFold(fk.Name, con)
+			}
+			for _, ck := range t.Checks {
+				found = found || strings.EqualFold(ck.Name, con)
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("overrides for constraint %s on %s, which doesn't exist", con, key))
+			}
+		}
+
+		if t.Filtered() {
+			var n int64
+			if err := msDB.QueryRow("SELECT COUNT_BIG(*) FROM " + t.MSSqlFrom()).Scan(&n); err != nil {
+				problems = append(problems, fmt.Sprintf("filter on %s: %s", key, err))
+			}
+		}
+	}
+
+	problems = append(problems, checkNames(tables)...)
+	sort.Strings(problems)
+	return problems
+}
+
+func matchesAnyTable(pattern string, names []tableName) bool {
+	for _, n := range names {
+		if matchAny(n, []string{pattern}) {
+			return true
+		}
+	}
+	return false
+}
+
+func runValidateConfig(cfg config, msDB *sql.DB) {
+	problems := validateConfig(cfg, msDB)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("%d problems found", len(problems))
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// How rows are written to Postgres
+const (
+	InsertModeInsert   = "insert"   // One INSERT per row
+	InsertModeCopy     = "copy"     // COPY FROM STDIN
+	InsertModeMultirow = "multirow" // INSERTs with many rows in the VALUES list
+)
+
+// Postgres allows at most this many bind parameters in one statement
+const psqlMaxParams = 65535
+
+type CopyOptions struct {
+	Mode      string
+	BatchSize int // Rows written per transaction
+
+	// Where bad rows go, when nil the copy stops at the first bad row
+	Rejects *RejectLog
+}
+
+// Writes rows to a Postgres table, committing a transaction every time Flush
+// is called.
+type rowWriter interface {
+	Write(row []interface{}) error
+	Flush() error
+	Abort()
+}
+
+func newRowWriter(db *sql.DB, table Table, opts CopyOptions) (rowWriter, error) {
+	switch opts.Mode {
+	case InsertModeInsert:
+		return &insertWriter{db: db, table: table}, nil
+	case InsertModeCopy, "":
+		return &copyWriter{db: db, table: table}, nil
+	case InsertModeMultirow:
+		perStmt := opts.BatchSize
+		if max := psqlMaxParams / len(table.Columns); perStmt > max {
+			perStmt = max
+		}
+		return &multirowWriter{db: db, table: table, perStmt: perStmt}, nil
+	}
+	return nil, fmt.Errorf("unknown insert mode %q", opts.Mode)
+}
+
+func CopyTable(from, to *sql.DB, table Table, opts CopyOptions) error {
+	return CopyChunk(from, to, table, nil, opts, log.New(os.Stderr, "", log.LstdFlags))
+}
+
+// Copy the rows of a table, or just those in chunk if it isn't nil
+func CopyChunk(from, to *sql.DB, table Table, chunk *Chunk, opts CopyOptions, logger *log.Logger) error {
+	w, err := newRowWriter(to, table, opts)
+	if err != nil {
+		return err
+	}
+	_, err = copyRows(from, to, w, table, chunk, opts, logger)
+	return err
+}
+
+// Read the rows of a table, or of one chunk, and hand them to w, returning
+// how many were read. Batches that fail are only replayed row by row when
+// there is a database to replay them into.
+func copyRows(from, to *sql.DB, w rowWriter, table Table, chunk *Chunk, opts CopyOptions, logger *log.Logger) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1
+	}
+
+	query := table.SelectMSSql()
+	if chunk != nil {
+		query = table.SelectMSSqlChunk(chunk)
+	}
+	rows, err := from.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	rr := make([]interface{}, len(table.Columns))
+	ra := make([]interface{}, len(table.Columns))
+	for i, _ := range ra {
+		ra[i] = &rr[i]
+	}
+
+	// Chunks are read in key order, keep track of the last key written so
+	// progress can be checkpointed after every commit. It never moves past a
+	// rejected row, so a run resumed after fixing the data reads it again,
+	// and the rows after it are cleared and copied again.
+	count := 0
+	keyIdx := -1
+	if chunk != nil && chunk.OnCommit != nil {
+		for i, c := range table.Columns {
+			if c.OriginalName == chunk.Column.OriginalName {
+				keyIdx = i
+			}
+		}
+	}
+	var lastKey, rejectedKey int64
+	written := false  // Rows before any rejected one were written since the last commit
+	rejected := false // A row was rejected, the checkpoint stays below rejectedKey
+	checkpoint := func(key int64) {
+		if keyIdx >= 0 {
+			chunk.OnCommit(key)
+		}
+	}
+	reject := func(key int64) {
+		if !rejected {
+			rejected, rejectedKey = true, key
+		}
+	}
+
+	// When bad rows are tolerated the rows since the last commit are kept,
+	// if the batch fails they are replayed one at a time to find the bad
+	// ones.
+	var batch [][]interface{}
+	var keys []int64 // The chunk key of each row in batch
+	replay := func(err error) error {
+		w.Abort()
+		written = false
+		if opts.Rejects == nil || to == nil {
+			return err
+		}
+		first, err := replayBatch(to, table, batch, opts.Rejects)
+		if err != nil {
+			return err
+		}
+		// The rows before the first one rejected are in Postgres
+		n := len(batch)
+		if first >= 0 {
+			n = first
+		}
+		for i := n - 1; i >= 0; i-- {
+			if !rejected || keys[i] < rejectedKey {
+				checkpoint(keys[i])
+				break
+			}
+		}
+		if first >= 0 {
+			reject(keys[first])
+		}
+		batch, keys = batch[:0], keys[:0]
+		return nil
+	}
+	commit := func() error {
+		if err := w.Flush(); err != nil {
+			return replay(err)
+		}
+		if written {
+			checkpoint(lastKey)
+		}
+		batch, keys = batch[:0], keys[:0]
+		written = false
+		return nil
+	}
+
+	for rows.Next() {
+		count++
+		var key int64
+		err := rows.Scan(ra...)
+		if err == nil && keyIdx >= 0 {
+			// Read before the row is transformed, it's the key in SQL Server
+			// the chunk is resumed from
+			if key, err = chunkKey(rr[keyIdx]); err != nil {
+				w.Abort()
+				return count, fmt.Errorf("%s: %s", chunk.Column.OriginalName, err)
+			}
+		}
+		if err == nil {
+			err = table.transformRow(rr)
+		}
+		if err != nil {
+			if opts.Rejects == nil {
+				w.Abort()
+				return count, err
+			}
+			if err := opts.Rejects.Reject(table, rr, err); err != nil {
+				w.Abort()
+				return count, err
+			}
+			reject(key)
+			continue
+		}
+		if opts.Rejects != nil {
+			batch = append(batch, append([]interface{}(nil), rr...))
+			keys = append(keys, key)
+		}
+		if err := w.Write(rr); err != nil {
+			if err := replay(err); err != nil {
+				return count, err
+			}
+		} else if !rejected {
+			lastKey, written = key, true
+		}
+		if count%opts.BatchSize == 0 {
+			if err := commit(); err != nil {
+				return count, err
+			}
+			logger.Printf("%s: %d", table.Key(), count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		w.Abort()
+		return count, err
+	}
+	if err := commit(); err != nil {
+		return count, err
+	}
+	logger.Printf("Copied %d rows into %s", count, table.Key())
+	return count, nil
+}
+
+// Row at a time INSERTs, the slowest but works everywhere
+type insertWriter struct {
+	db    *sql.DB
+	table Table
+	tx    *sql.Tx
+	bytea []bool
+}
+
+func (w *insertWriter) Write(row []interface{}) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+	if w.bytea == nil {
+		w.bytea = w.table.byteaColumns()
+	}
+	_, err := w.tx.Exec(w.table.InsertPsql(), textValues(row, w.bytea)...)
+	return err
+}
+
+func (w *insertWriter) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	return err
+}
+
+func (w *insertWriter) Abort() {
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx = nil
+	}
+}
+
+// Streams rows through COPY FROM STDIN
+type copyWriter struct {
+	db    *sql.DB
+	table Table
+	tx    *sql.Tx
+	stmt  *sql.Stmt
+	bytea []bool
+}
+
+func (w *copyWriter) Write(row []interface{}) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(pq.CopyInSchema(w.table.NewSchema, w.table.NewName, w.table.newNames()...))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		w.tx, w.stmt = tx, stmt
+	}
+	if w.bytea == nil {
+		w.bytea = w.table.byteaColumns()
+	}
+	_, err := w.stmt.Exec(textValues(row, w.bytea)...)
+	return err
+}
+
+// Which columns are BYTEA in Postgres
+func (t *Table) byteaColumns() []bool {
+	bytea := make([]bool, len(t.Columns))
+	for i, c := range t.Columns {
+		typ, _ := c.PostgresType()
+		bytea[i] = strings.EqualFold(typ, "BYTEA")
+	}
+	return bytea
+}
+
+// lib/pq sends every []byte as bytea, anything else (decimals, money) needs
+// to go as text.
+func textValues(row []interface{}, bytea []bool) []interface{} {
+	vals := make([]interface{}, len(row))
+	for i, v := range row {
+		if b, ok := v.([]byte); ok && !bytea[i] {
+			v = string(b)
+		}
+		vals[i] = v
+	}
+	return vals
+}
+
+func (w *copyWriter) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	defer func() { w.tx, w.stmt = nil, nil }()
+	if _, err := w.stmt.Exec(); err != nil {
+		w.tx.Rollback()
+		return err
+	}
+	if err := w.stmt.Close(); err != nil {
+		w.tx.Rollback()
+		return err
+	}
+	return w.tx.Commit()
+}
+
+func (w *copyWriter) Abort() {
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx, w.stmt = nil, nil
+	}
+}
+
+// Batches rows into multi-row INSERT statements, for targets where COPY isn't
+// allowed.
+type multirowWriter struct {
+	db      *sql.DB
+	table   Table
+	perStmt int
+	tx      *sql.Tx
+	pending []interface{}
+	bytea   []bool
+}
+
+func (w *multirowWriter) Write(row []interface{}) error {
+	// The scan buffer is reused for every row, so take a copy
+	if w.bytea == nil {
+		w.bytea = w.table.byteaColumns()
+	}
+	w.pending = append(w.pending, textValues(row, w.bytea)...)
+	if len(w.pending) >= w.perStmt*len(w.table.Columns) {
+		return w.exec()
+	}
+	return nil
+}
+
+func (w *multirowWriter) exec() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+	n := len(w.pending) / len(w.table.Columns)
+	_, err := w.tx.Exec(w.table.InsertPsqlRows(n), w.pending...)
+	w.pending = w.pending[:0]
+	return err
+}
+
+func (w *multirowWriter) Flush() error {
+	if err := w.exec(); err != nil {
+		w.Abort()
+		return err
+	}
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	return err
+}
+
+func (w *multirowWriter) Abort() {
+	w.pending = w.pending[:0]
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx = nil
+	}
+}
+
+// The new column names in order
+func (t *Table) newNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = c.NewName
+	}
+	return names
+}
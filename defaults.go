@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	numberLiteral = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+	stringLiteral = regexp.MustCompile(`^N?'((?:[^']|'')*)'$`)
+
+	// CONVERT([type],x) and CAST(x AS [type]), with the type's size if any
+	convertCall = regexp.MustCompile(`(?is)^convert\s*\(\s*\[?(\w+)\]?\s*(?:\([^)]*\))?\s*,(.*)\)$`)
+	castCall    = regexp.MustCompile(`(?is)^cast\s*\((.*)\s+as\s+\[?(\w+)\]?\s*(?:\([^)]*\))?\s*\)$`)
+)
+
+// SQL Server functions that have a direct Postgres equivalent when used as a
+// column default, keyed by the lower cased call.
+var defaultFunctions = map[string]string{
+	"getdate()":               "CURRENT_TIMESTAMP",
+	"sysdatetime()":           "CURRENT_TIMESTAMP",
+	"current_timestamp":       "CURRENT_TIMESTAMP",
+	"sysdatetimeoffset()":     "CURRENT_TIMESTAMP",
+	"getutcdate()":            "(CURRENT_TIMESTAMP AT TIME ZONE 'UTC')",
+	"sysutcdatetime()":        "(CURRENT_TIMESTAMP AT TIME ZONE 'UTC')",
+	"newid()":                 "gen_random_uuid()",
+	"newsequentialid()":       "gen_random_uuid()",
+	"user_name()":             "CURRENT_USER",
+	"suser_sname()":           "CURRENT_USER",
+	"suser_name()":            "CURRENT_USER",
+	"current_user":            "CURRENT_USER",
+	"host_name()":             "inet_client_addr()::TEXT",
+	"db_name()":               "current_database()",
+	"cast(getdate() as date)": "CURRENT_DATE",
+}
+
+// Translate a COLUMN_DEF from sp_columns into a Postgres default expression.
+// An empty string with a nil error means there is no default to set.
+func TranslateDefault(col *MSSqlColumn) (string, error) {
+	def := unwrapParens(strings.TrimSpace(col.COLUMN_DEF))
+	if def == "" || strings.EqualFold(def, "NULL") {
+		return "", nil
+	}
+
+	isBit := col.BaseTypeName() == "bit"
+	def = unwrapConvert(def, col.BaseTypeName())
+
+	if numberLiteral.MatchString(def) {
+		if !isBit {
+			return def, nil
+		}
+		if out, ok := bitLiteral(def); ok {
+			return out, nil
+		}
+	} else if m := stringLiteral.FindStringSubmatch(def); m != nil {
+		if !isBit {
+			return "'" + m[1] + "'", nil
+		}
+		if out, ok := bitLiteral(m[1]); ok {
+			return out, nil
+		}
+	} else if out, ok := defaultFunctions[strings.ToLower(def)]; ok {
+		return out, nil
+	}
+
+	return "", fmt.Errorf("%s.%s: can't translate default %s", col.TABLE_NAME, col.COLUMN_NAME, col.COLUMN_DEF)
+}
+
+// Tools like SSMS write defaults as a conversion to the column's own type, eg
+// (CONVERT([bit],(0))). Those are dropped so the literal inside can be
+// matched, conversions to other types are left alone.
+func unwrapConvert(def, typ string) string {
+	if m := convertCall.FindStringSubmatch(def); m != nil && strings.EqualFold(m[1], typ) && balanced(m[2]) {
+		return unwrapParens(strings.TrimSpace(m[2]))
+	}
+	if m := castCall.FindStringSubmatch(def); m != nil && strings.EqualFold(m[2], typ) && balanced(m[1]) {
+		return unwrapParens(strings.TrimSpace(m[1]))
+	}
+	return def
+}
+
+// SQL Server wraps defaults in a layer or two of brackets, ((0)) or ('text')
+func unwrapParens(def string) string {
+	for strings.HasPrefix(def, "(") && strings.HasSuffix(def, ")") && balanced(def[1:len(def)-1]) {
+		def = strings.TrimSpace(def[1 : len(def)-1])
+	}
+	return def
+}
+
+// Check that the brackets in s pair up, ignoring any inside string literals
+func balanced(s string) bool {
+	depth := 0
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0 && !quoted
+}
+
+// As a bit any number other than 0 is 1, and the strings TRUE and FALSE are 1
+// and 0
+func bitLiteral(v string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true":
+		return "TRUE", true
+	case "false":
+		return "FALSE", true
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return "", false
+	}
+	if f == 0 {
+		return "FALSE", true
+	}
+	return "TRUE", true
+}
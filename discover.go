@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"path"
+	"strings"
+)
+
+// List every user table in a schema
+func discoverTables(db *sql.DB, schema string) []tableName {
+	rows, err := db.Query(`SELECT TABLE_SCHEMA, TABLE_NAME FROM INFORMATION_SCHEMA.TABLES
+		WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA = ?
+		ORDER BY TABLE_NAME`, schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []tableName{}
+	defer rows.Close()
+	for rows.Next() {
+		var name tableName
+		if err := rows.Scan(&name.Schema, &name.Name); err != nil {
+			log.Fatal(err)
+		}
+		out = append(out, name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// Keep the tables matching any of the include patterns (or all of them if
+// there are none) and none of the exclude patterns. Patterns are shell globs
+// matched against either the table name or schema.table and, like SQL Server
+// names, case insensitive.
+func filterTables(names []tableName, include, exclude []string) []tableName {
+	out := []tableName{}
+	for _, n := range names {
+		if (len(include) == 0 || matchAny(n, include)) && !matchAny(n, exclude) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func matchAny(name tableName, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if ok, _ := path.Match(p, strings.ToLower(name.Name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, strings.ToLower(name.String())); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Order tables so every table comes after the ones its foreign keys reference.
+// Where the foreign keys form a cycle it is broken at an arbitrary table.
+func sortByDependencies(tables []Table) []Table {
+	index := map[string]int{}
+	for i, t := range tables {
+		index[strings.ToLower(t.OriginalSchema+"."+t.OriginalName)] = i
+	}
+
+	done := make([]bool, len(tables))
+	visiting := make([]bool, len(tables))
+	out := make([]Table, 0, len(tables))
+	cyclic := false
+
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] {
+			return
+		}
+		if visiting[i] {
+			cyclic = true
+			return
+		}
+		visiting[i] = true
+		for _, fk := range tables[i].ForeignKeys {
+			if j, ok := index[strings.ToLower(fk.RefSchema+"."+fk.RefTable)]; ok && j != i {
+				visit(j)
+			}
+		}
+		visiting[i] = false
+		if !done[i] {
+			done[i] = true
+			out = append(out, tables[i])
+		}
+	}
+
+	for i := range tables {
+		visit(i)
+	}
+	if cyclic {
+		log.Println("Warning: foreign keys form a cycle, some tables will load before the tables they reference")
+	}
+	return out
+}
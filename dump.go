@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Formats tables can be exported in
+const (
+	DumpFormatText = "text" // COPY's default text format
+	DumpFormatCSV  = "csv"
+)
+
+const manifestFile = "manifest.json"
+
+// Describes an export directory: the DDL to run around the load and a data
+// file for each table, in the order they should be loaded. PreData creates the
+// schemas, each table carries the statements creating it.
+type dumpManifest struct {
+	Format   string      `json:"format"`
+	Gzip     bool        `json:"gzip"`
+	PreData  []string    `json:"pre_data"`
+	PostData []string    `json:"post_data"`
+	Tables   []dumpTable `json:"tables"`
+}
+
+type dumpTable struct {
+	Source  string   `json:"source"` // schema.table in SQL Server
+	Schema  string   `json:"schema"`
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	File    string   `json:"file"`
+	Rows    int64    `json:"rows"`
+	PreData []string `json:"pre_data"`
+}
+
+func (d dumpTable) Key() string {
+	return d.Schema + "." + d.Name
+}
+
+// Writes rows to a file in the text form Postgres reads them in, converting
+// values the same way lib/pq does when copying directly.
+type fileWriter struct {
+	w      *bufio.Writer
+	format string
+	bytea  []bool
+	rows   int64
+}
+
+func (w *fileWriter) Write(row []interface{}) error {
+	for i, v := range row {
+		if i > 0 {
+			if w.format == DumpFormatCSV {
+				w.w.WriteByte(',')
+			} else {
+				w.w.WriteByte('\t')
+			}
+		}
+		if v == nil {
+			if w.format != DumpFormatCSV {
+				w.w.WriteString(`\N`)
+			}
+			continue
+		}
+		s := psqlText(v, w.bytea[i])
+		if w.format == DumpFormatCSV {
+			w.w.WriteString(`"` + strings.Replace(s, `"`, `""`, -1) + `"`)
+		} else {
+			w.w.WriteString(escapeCopyText(s))
+		}
+	}
+	w.rows++
+	return w.w.WriteByte('\n')
+}
+
+func (w *fileWriter) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *fileWriter) Abort() {}
+
+// The text Postgres parses a value from
+func psqlText(v interface{}, bytea bool) string {
+	switch x := v.(type) {
+	case []byte:
+		if bytea {
+			return `\x` + hex.EncodeToString(x)
+		}
+		return string(x)
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		switch {
+		case math.IsInf(x, 1):
+			return "Infinity"
+		case math.IsInf(x, -1):
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case time.Time:
+		return string(pq.FormatTimestamp(x))
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func escapeCopyText(s string) string {
+	return copyEscaper.Replace(s)
+}
+
+// Export every table to its own file in dir along with a manifest
+func exportTables(cfg config, msDB *sql.DB, tables []Table, views []View, triggers []Trigger, dir string) error {
+	if cfg.format != DumpFormatText && cfg.format != DumpFormatCSV {
+		return fmt.Errorf("unknown format %q, expected text or csv", cfg.format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	sections := exportSections(tables, views, triggers)
+	m := dumpManifest{Format: cfg.format, Gzip: cfg.gzip, PostData: sections.PostData}
+	for _, stmt := range createSchemaSql(tables) {
+		m.PreData = append(m.PreData, stmt+";")
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	for i, t := range tables {
+		ext := ".copy"
+		if cfg.format == DumpFormatCSV {
+			ext = ".csv"
+		}
+		if cfg.gzip {
+			ext += ".gz"
+		}
+		d := dumpTable{
+			Source:  t.OriginalSchema + "." + t.OriginalName,
+			Schema:  t.NewSchema,
+			Name:    t.NewName,
+			Columns: t.newNames(),
+			File:    fmt.Sprintf("%04d-%s%s", i+1, preserveName(t.Key()), ext),
+			PreData: tablePreData(t),
+		}
+
+		log.Println("Exporting ", t.Key())
+		rows, err := exportTable(cfg, msDB, t, filepath.Join(dir, d.File), logger)
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.Key(), err)
+		}
+		d.Rows = rows
+		m.Tables = append(m.Tables, d)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, manifestFile), data, 0644)
+}
+
+func exportTable(cfg config, msDB *sql.DB, t Table, path string, logger *log.Logger) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if cfg.gzip {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+	w := &fileWriter{w: bufio.NewWriter(out), format: cfg.format, bytea: t.byteaColumns()}
+	if _, err := copyRows(msDB, nil, w, t, nil, cfg.copy, logger); err != nil {
+		return 0, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return w.rows, f.Close()
+}
+
+// Reads rows back from an export file as the text of each value, nil for NULL
+type fileReader interface {
+	Read() ([]interface{}, error)
+}
+
+type copyTextReader struct {
+	r *bufio.Reader
+}
+
+func (r *copyTextReader) Read() ([]interface{}, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	row := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if f == `\N` {
+			continue
+		}
+		row[i] = unescapeCopyText(f)
+	}
+	return row, nil
+}
+
+func unescapeCopyText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// CSV as Postgres writes it, where an unquoted empty field is NULL and a
+// quoted one an empty string, which encoding/csv can't tell apart.
+type csvReader struct {
+	r *bufio.Reader
+}
+
+func (r *csvReader) Read() ([]interface{}, error) {
+	row := []interface{}{}
+	var field strings.Builder
+	quoted, inQuotes, started := false, false, false
+	end := func() {
+		if quoted || field.Len() > 0 {
+			row = append(row, field.String())
+		} else {
+			row = append(row, nil)
+		}
+		field.Reset()
+		quoted = false
+	}
+	for {
+		c, err := r.r.ReadByte()
+		if err == io.EOF {
+			if !started {
+				return nil, io.EOF
+			}
+			if inQuotes {
+				return nil, fmt.Errorf("unterminated quoted field")
+			}
+			end()
+			return row, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		started = true
+		switch {
+		case inQuotes && c == '"':
+			if next, err := r.r.Peek(1); err == nil && next[0] == '"' {
+				r.r.ReadByte()
+				field.WriteByte('"')
+			} else {
+				inQuotes = false
+			}
+		case inQuotes:
+			field.WriteByte(c)
+		case c == '"':
+			inQuotes, quoted = true, true
+		case c == ',':
+			end()
+		case c == '\n':
+			end()
+			return row, nil
+		case c == '\r':
+		default:
+			field.WriteByte(c)
+		}
+	}
+}
+
+// Load an export directory into Postgres: run the pre-data DDL, COPY each
+// file in and then run the post-data DDL. Progress is kept in state like a
+// migration so a failed import can be resumed.
+func importTables(cfg config, psqlDB *sql.DB, dir string, state *State) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	m := dumpManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %s", manifestFile, err)
+	}
+
+	if cfg.drop {
+		for _, d := range m.Tables {
+			if state.Table(d.Key()).Created {
+				continue
+			}
+			log.Println("Dropping  ", d.Key())
+			drop := fmt.Sprintf("DROP TABLE IF EXISTS %s.%s CASCADE", quotePsql(d.Schema), quotePsql(d.Name))
+			if _, err := psqlDB.Exec(drop); err != nil {
+				return err
+			}
+		}
+	}
+	// Only tables an earlier run didn't get to are created, the rest keep
+	// their progress
+	if !allCreated(m, state) {
+		for _, stmt := range m.PreData {
+			if _, err := psqlDB.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range m.Tables {
+		ts := state.Table(d.Key())
+		if ts.Created {
+			continue
+		}
+		for _, stmt := range d.PreData {
+			if _, err := psqlDB.Exec(stmt); err != nil {
+				return fmt.Errorf("%s: %s", d.Key(), err)
+			}
+		}
+		if err := state.Update(func() { ts.Created = true }); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range m.Tables {
+		ts := state.Table(d.Key())
+		if ts.Done {
+			log.Println("Skipping  ", d.Key(), "already imported")
+			continue
+		}
+		log.Println("Importing ", d.Key())
+		count, err := importTable(psqlDB, m, d, filepath.Join(dir, d.File), cfg.copy.BatchSize)
+		if err != nil {
+			return fmt.Errorf("%s: %s", d.Key(), err)
+		}
+		if count != d.Rows {
+			return fmt.Errorf("%s: loaded %d rows but the manifest says %d", d.Key(), count, d.Rows)
+		}
+		if err := state.Update(func() { ts.Done = true }); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range m.PostData {
+		if strings.HasPrefix(stmt, "--") {
+			continue
+		}
+		if _, err := psqlDB.Exec(stmt); err != nil {
+			log.Printf("Warning: %s", err)
+		}
+	}
+	return nil
+}
+
+func allCreated(m dumpManifest, state *State) bool {
+	for _, d := range m.Tables {
+		if !state.Table(d.Key()).Created {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty the table and COPY a file into it, committing every batchSize rows
+func importTable(db *sql.DB, m dumpManifest, d dumpTable, path string, batchSize int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if m.Gzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	var r fileReader = &copyTextReader{r: bufio.NewReader(in)}
+	if m.Format == DumpFormatCSV {
+		r = &csvReader{r: bufio.NewReader(in)}
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("TRUNCATE %s.%s", quotePsql(d.Schema), quotePsql(d.Name))); err != nil {
+		return 0, err
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	var tx *sql.Tx
+	var stmt *sql.Stmt
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		defer func() { tx, stmt = nil, nil }()
+		if _, err := stmt.Exec(); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := stmt.Close(); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var count int64
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return count, fmt.Errorf("row %d: %s", count+1, err)
+		}
+		if len(row) != len(d.Columns) {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return count, fmt.Errorf("row %d has %d values, expected %d", count+1, len(row), len(d.Columns))
+		}
+		if tx == nil {
+			if tx, err = db.Begin(); err != nil {
+				return count, err
+			}
+			if stmt, err = tx.Prepare(pq.CopyInSchema(d.Schema, d.Name, d.Columns...)); err != nil {
+				tx.Rollback()
+				return count, err
+			}
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			tx.Rollback()
+			return count, err
+		}
+		count++
+		if count%int64(batchSize) == 0 {
+			if err := commit(); err != nil {
+				return count, err
+			}
+			log.Printf("%s: %d", d.Key(), count)
+		}
+	}
+	return count, commit()
+}
+
+func runExport(cfg config, msDB *sql.DB, tables []Table, views []View, triggers []Trigger) {
+	if err := exportTables(cfg, msDB, tables, views, triggers, cfg.to); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Exported %d tables to %s", len(tables), cfg.to)
+	reportReview(cfg, append(viewReview(views), triggerReview(triggers)...))
+}
+
+func runImport(cfg config) {
+	state := NewState(cfg.stateFile)
+	if cfg.resume {
+		var err error
+		if state, err = LoadState(cfg.stateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	psqlDB := ConnectAndTest("postgres", cfg.to)
+	if err := importTables(cfg, psqlDB, cfg.from, state); err != nil {
+		log.Fatal(err)
+	}
+}
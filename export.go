@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The parts of a schema export, split the same way as pg_dump's sections
+type schemaSections struct {
+	PreData  []string // Schemas and tables
+	Data     []string // The order tables should be loaded in
+	PostData []string // Keys, indexes, constraints, identity resets, views and triggers
+}
+
+var sectionFiles = []string{"pre-data.sql", "data.sql", "post-data.sql"}
+
+// Generate the statements for every section. Anything that can't be
+// translated is left in as a comment saying why, for whoever reviews it.
+func exportSections(tables []Table, views []View, triggers []Trigger) schemaSections {
+	s := schemaSections{}
+
+	for _, stmt := range createSchemaSql(tables) {
+		s.PreData = append(s.PreData, stmt+";")
+	}
+	for _, t := range tables {
+		s.PreData = append(s.PreData, tablePreData(t)...)
+	}
+
+	s.Data = append(s.Data, "-- Load the tables in this order, eg with mssql_migrate migrate")
+	for _, t := range tables {
+		s.Data = append(s.Data, "-- "+t.Key())
+	}
+
+	for _, t := range tables {
+		if pk := t.PrimaryKeySql(); pk != "" {
+			s.PostData = append(s.PostData, pk+";")
+		}
+	}
+	for i := range tables {
+		t := &tables[i]
+		for _, ix := range t.Indexes {
+			stmt, err := ix.CreateSql(t)
+			s.PostData = append(s.PostData, sqlOrSkipped(stmt, err, "index "+ix.Name))
+		}
+		for _, ck := range t.Checks {
+			stmt, err := ck.CreateSql(t)
+			s.PostData = append(s.PostData, sqlOrSkipped(stmt, err, "check constraint "+ck.Name))
+		}
+	}
+	for i := range tables {
+		t := &tables[i]
+		for _, fk := range t.ForeignKeys {
+			stmt, err := fk.CreateSql(t, tables)
+			s.PostData = append(s.PostData, sqlOrSkipped(stmt, err, "foreign key "+fk.Name))
+		}
+	}
+	for _, t := range tables {
+		if reset := t.ResetIdentitySql(); reset != "" {
+			s.PostData = append(s.PostData, reset+";")
+		}
+	}
+	for _, v := range views {
+		if len(v.Issues) > 0 {
+			s.PostData = append(s.PostData, fmt.Sprintf("-- Skipped view %s: needs review", v.Key()))
+			continue
+		}
+		s.PostData = append(s.PostData, v.Sql+";")
+	}
+	for _, t := range triggers {
+		if len(t.Issues) > 0 {
+			s.PostData = append(s.PostData, fmt.Sprintf("-- Skipped trigger %s: needs review", t.Key()))
+			continue
+		}
+		for _, stmt := range t.statements() {
+			s.PostData = append(s.PostData, stmt+";")
+		}
+	}
+	return s
+}
+
+func sqlOrSkipped(stmt string, err error, what string) string {
+	if err != nil {
+		return fmt.Sprintf("-- Skipped %s: %s", what, err)
+	}
+	return stmt + ";"
+}
+
+func (s schemaSections) all() [][]string {
+	return [][]string{s.PreData, s.Data, s.PostData}
+}
+
+// The statements creating a table and the view of its computed columns
+func tablePreData(t Table) []string {
+	createSql, err := t.CreateSqlWithoutKey()
+	if err != nil {
+		return []string{fmt.Sprintf("-- Skipped table %s: %s", t.Key(), err)}
+	}
+	out := []string{createSql + ";"}
+	if viewSql := t.ComputedViewSql(); viewSql != "" {
+		out = append(out, viewSql+";")
+	}
+	return out
+}
+
+func writeSection(w io.Writer, name string, stmts []string) error {
+	if _, err := fmt.Fprintf(w, "--\n-- %s\n--\n\n", name); err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := fmt.Fprintf(w, "%s\n\n", stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the sections to one file, or to a file each if path is a directory
+// (or ends in a slash)
+func writeSchemaExport(path string, s schemaSections) error {
+	info, err := os.Stat(path)
+	dir := strings.HasSuffix(path, "/") || (err == nil && info.IsDir())
+	if !dir {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		for i, stmts := range s.all() {
+			if err := writeSection(f, strings.TrimSuffix(sectionFiles[i], ".sql"), stmts); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		return f.Close()
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	for i, stmts := range s.all() {
+		f, err := os.Create(filepath.Join(path, sectionFiles[i]))
+		if err != nil {
+			return err
+		}
+		if err := writeSection(f, strings.TrimSuffix(sectionFiles[i], ".sql"), stmts); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runExportSchema(cfg config, tables []Table, views []View, triggers []Trigger) {
+	if err := writeSchemaExport(cfg.output, exportSections(tables, views, triggers)); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote the schema for %d tables to %s", len(tables), cfg.output)
+	reportReview(cfg, append(viewReview(views), triggerReview(triggers)...))
+}
@@ -0,0 +1,1299 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokSpace  tokenKind = iota
+	tokIdent            // Bare identifier or keyword
+	tokQuoted           // [bracketed] or "quoted" identifier
+	tokString           // 'string' or N'string'
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokDot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// The identifier a token names, without brackets or quotes
+func (t token) name() string {
+	if t.kind == tokQuoted {
+		return strings.Replace(t.text[1:len(t.text)-1], "]]", "]", -1)
+	}
+	return t.text
+}
+
+// Split T-SQL into tokens, keeping whitespace so it can be put back together.
+func tokenize(sql string) ([]token, error) {
+	toks := []token{}
+	rs := []rune(sql)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		start := i
+		var kind tokenKind
+		switch {
+		case unicode.IsSpace(r):
+			for i < len(rs) && unicode.IsSpace(rs[i]) {
+				i++
+			}
+			kind = tokSpace
+		case r == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+			kind = tokSpace
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			end := strings.Index(string(rs[i+2:]), "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += 2 + len([]rune(string(rs[i+2:])[:end])) + 2
+			kind = tokSpace
+		case r == '[' || r == '"':
+			closer := ']'
+			if r == '"' {
+				closer = '"'
+			}
+			i++
+			for {
+				if i >= len(rs) {
+					return nil, fmt.Errorf("unterminated identifier")
+				}
+				if rs[i] == closer {
+					if i+1 < len(rs) && rs[i+1] == closer {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			kind = tokQuoted
+		case r == '\'' || ((r == 'N' || r == 'n') && i+1 < len(rs) && rs[i+1] == '\''):
+			if r != '\'' {
+				i++
+			}
+			i++
+			for {
+				if i >= len(rs) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if rs[i] == '\'' {
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			kind = tokString
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || rs[i] == 'e' || rs[i] == 'E') {
+				i++
+			}
+			kind = tokNumber
+		case unicode.IsLetter(r) || r == '_' || r == '@' || r == '#':
+			for i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || strings.ContainsRune("_@#$", rs[i])) {
+				i++
+			}
+			kind = tokIdent
+		case r == '(':
+			i++
+			kind = tokLParen
+		case r == ')':
+			i++
+			kind = tokRParen
+		case r == ',':
+			i++
+			kind = tokComma
+		case r == '.':
+			i++
+			kind = tokDot
+		default:
+			// Runs of operator characters, <> >= != etc
+			for i < len(rs) && strings.ContainsRune("<>=!+-*/%&|^~;", rs[i]) {
+				i++
+			}
+			if i == start {
+				i++
+			}
+			kind = tokOp
+		}
+		toks = append(toks, token{kind: kind, text: string(rs[start:i])})
+	}
+	return toks, nil
+}
+
+func joinTokens(toks []token) string {
+	parts := make([]string, len(toks))
+	for i, t := range toks {
+		parts[i] = t.text
+	}
+	return strings.Join(parts, "")
+}
+
+// Whether the token is one of the given keywords
+func (t token) is(words ...string) bool {
+	if t.kind != tokIdent {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Words that are never names, so are left alone when names are translated
+var sqlKeywords = map[string]bool{
+	"all": true, "and": true, "any": true, "apply": true, "as": true, "asc": true,
+	"between": true, "by": true, "case": true, "check": true, "collate": true,
+	"cross": true, "current_timestamp": true, "current_user": true, "desc": true,
+	"distinct": true, "else": true, "end": true, "escape": true, "except": true,
+	"exists": true, "fetch": true, "first": true, "following": true, "for": true,
+	"from": true, "full": true, "group": true, "having": true, "in": true,
+	"inner": true, "intersect": true, "into": true, "is": true, "join": true,
+	"left": true, "like": true, "next": true, "not": true, "null": true,
+	"offset": true, "on": true, "only": true, "option": true, "or": true,
+	"order": true, "outer": true, "over": true, "partition": true, "percent": true,
+	"pivot": true, "preceding": true, "range": true, "right": true, "row": true,
+	"rows": true, "select": true, "session_user": true, "some": true, "system_user": true,
+	"then": true, "ties": true, "top": true, "unbounded": true, "union": true,
+	"unpivot": true, "user": true, "values": true, "view": true, "when": true,
+	"where": true, "with": true, "current": true,
+
+	// Statements, which routines don't always end with a semicolon
+	"begin": true, "break": true, "commit": true, "continue": true, "declare": true,
+	"delete": true, "exec": true, "execute": true, "goto": true, "if": true,
+	"insert": true, "merge": true, "output": true, "print": true, "raiserror": true,
+	"return": true, "returns": true, "rollback": true, "set": true, "throw": true,
+	"truncate": true, "update": true, "while": true,
+}
+
+func isKeyword(t token) bool {
+	return t.kind == tokIdent && sqlKeywords[strings.ToLower(t.text)]
+}
+
+// Functions that only differ from Postgres by name
+var exprFunctions = map[string]string{
+	"getdate":     "now",
+	"sysdatetime": "now",
+	"isnull":      "coalesce",
+	"len":         "length",
+	"datalength":  "octet_length",
+	"newid":       "gen_random_uuid",
+	"ceiling":     "ceil",
+	"db_name":     "current_database",
+	"replicate":   "repeat",
+	"log10":       "log",
+	"atn2":        "atan2",
+}
+
+// Calls without arguments that become a whole expression
+var exprNiladic = map[string]string{
+	"getutcdate":     "timezone('UTC', now())",
+	"sysutcdatetime": "timezone('UTC', now())",
+	"user_name":      "current_user",
+	"suser_sname":    "current_user",
+}
+
+// Functions that work the same in Postgres, anything else called from a
+// query needs reviewing
+var psqlFunctions = map[string]bool{
+	"abs": true, "acos": true, "asin": true, "atan": true, "avg": true, "ceil": true,
+	"coalesce": true, "concat": true, "concat_ws": true, "cos": true, "count": true,
+	"cume_dist": true, "degrees": true, "dense_rank": true, "exp": true, "exists": true,
+	"first_value": true, "floor": true, "lag": true, "last_value": true, "lead": true,
+	"left": true, "length": true, "lower": true, "ltrim": true, "max": true, "min": true,
+	"ntile": true, "nullif": true, "percent_rank": true, "pi": true, "power": true,
+	"radians": true, "rank": true, "replace": true, "reverse": true, "right": true,
+	"round": true, "row_number": true, "rtrim": true, "sign": true, "sin": true,
+	"sqrt": true, "string_agg": true, "substring": true, "sum": true, "tan": true,
+	"trim": true, "upper": true, "in": true, "over": true, "values": true,
+}
+
+// Functions that return text, so a + next to them concatenates
+var textFunctions = map[string]bool{
+	"char": true, "concat": true, "concat_ws": true, "datename": true, "format": true,
+	"left": true, "lower": true, "ltrim": true, "nchar": true, "quotename": true,
+	"replace": true, "replicate": true, "reverse": true, "right": true, "rtrim": true,
+	"space": true, "str": true, "string_agg": true, "stuff": true, "substring": true,
+	"trim": true, "upper": true,
+}
+
+// DATEADD, DATEDIFF and DATEPART's date parts and their abbreviations, as
+// Postgres calls them
+var dateParts = map[string]string{
+	"year": "year", "yy": "year", "yyyy": "year",
+	"quarter": "quarter", "qq": "quarter", "q": "quarter",
+	"month": "month", "mm": "month", "m": "month",
+	"dayofyear": "doy", "dy": "doy", "y": "doy",
+	"day": "day", "dd": "day", "d": "day",
+	"week": "week", "wk": "week", "ww": "week",
+	"iso_week": "isoweek", "isowk": "isoweek", "isoww": "isoweek",
+	"weekday": "dow", "dw": "dow", "w": "dow",
+	"hour": "hour", "hh": "hour",
+	"minute": "minute", "mi": "minute", "n": "minute",
+	"second": "second", "ss": "second", "s": "second",
+	"millisecond": "millisecond", "ms": "millisecond",
+	"microsecond": "microsecond", "mcs": "microsecond",
+}
+
+// CONVERT's date styles as to_char/to_timestamp formats
+var convertStyles = map[int]string{
+	1: "MM/DD/YY", 101: "MM/DD/YYYY",
+	2: "YY.MM.DD", 102: "YYYY.MM.DD",
+	3: "DD/MM/YY", 103: "DD/MM/YYYY",
+	4: "DD.MM.YY", 104: "DD.MM.YYYY",
+	5: "DD-MM-YY", 105: "DD-MM-YYYY",
+	10: "MM-DD-YY", 110: "MM-DD-YYYY",
+	11: "YY/MM/DD", 111: "YYYY/MM/DD",
+	12: "YYMMDD", 112: "YYYYMMDD",
+	8: "HH24:MI:SS", 108: "HH24:MI:SS", 24: "HH24:MI:SS",
+	20: "YYYY-MM-DD HH24:MI:SS", 120: "YYYY-MM-DD HH24:MI:SS",
+	21: "YYYY-MM-DD HH24:MI:SS.MS", 121: "YYYY-MM-DD HH24:MI:SS.MS", 25: "YYYY-MM-DD HH24:MI:SS.MS",
+	23:  "YYYY-MM-DD",
+	126: `YYYY-MM-DD"T"HH24:MI:SS.MS`, 127: `YYYY-MM-DD"T"HH24:MI:SS.MS`,
+}
+
+// Translates T-SQL into Postgres a token at a time. Names are looked up in
+// the relations the SQL can see and anything that can't be translated is
+// noted in issues, rather than failing at the first problem, so it can all
+// be reported at once.
+type translator struct {
+	toks      []token
+	tables    []*Table          // Where an unqualified column could come from
+	schema    string            // Schema unqualified relations are looked for in
+	relations map[string]*Table // Tables and views, keyed by lower case schema.name
+	aliases   map[string]alias  // Keyed by lower case alias or table name
+	ctes      map[string]bool
+	refs      map[int]*Table         // Token indexes of relation references
+	skip      map[int]int            // Token ranges to leave out, eg table hints
+	namer     *Namer                 // Names anything unknown in a query, nil for expressions
+	vars      map[string]variable    // A routine's parameters and variables, keyed by lower case @name
+	pseudo    map[string]pseudoTable // A trigger's inserted and deleted, keyed by lower case name
+	issues    []string
+}
+
+// The inserted or deleted table of a trigger
+type pseudoTable struct {
+	table *Table // The table the trigger is on
+	text  string // What replaces the name where it's selected from
+	row   string // NEW or OLD in a row level trigger, empty in a statement level one
+}
+
+type variable struct {
+	name string // As written in Postgres
+	kind valueKind
+}
+
+type alias struct {
+	table *Table // Nil for derived tables and CTEs
+	text  string // How the alias is written in Postgres
+}
+
+// A translator for an expression on a single table, as in check constraints
+// and filtered indexes
+func newExprTranslator(expr string, table *Table) (*translator, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &translator{toks: toks, skip: map[int]int{}, refs: map[int]*Table{}, aliases: map[string]alias{}}
+	if table != nil {
+		tr.tables = []*Table{table}
+	}
+	return tr, nil
+}
+
+// A translator for a whole query that can refer to any of relations.
+// Unqualified relations are looked for in schema and then dbo.
+func newQueryTranslator(sql, schema string, relations map[string]*Table, namer *Namer) (*translator, error) {
+	return newTriggerTranslator(sql, schema, relations, namer, nil)
+}
+
+// A query translator where the pseudo tables can be selected from as well
+func newTriggerTranslator(sql, schema string, relations map[string]*Table, namer *Namer, pseudo map[string]pseudoTable) (*translator, error) {
+	toks, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	tr := &translator{
+		toks:      toks,
+		schema:    schema,
+		relations: relations,
+		aliases:   map[string]alias{},
+		ctes:      map[string]bool{},
+		refs:      map[int]*Table{},
+		skip:      map[int]int{},
+		namer:     namer,
+		pseudo:    pseudo,
+	}
+	tr.scope()
+	return tr, nil
+}
+
+func (tr *translator) issue(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	for _, i := range tr.issues {
+		if i == msg {
+			return
+		}
+	}
+	tr.issues = append(tr.issues, msg)
+}
+
+// Rewrite a T-SQL expression, as found in check constraints and filtered
+// indexes, into Postgres. Column names are mapped to their new names, string
+// literals lose their N prefix, 0 and 1 compared against bit columns become
+// booleans and functions with a direct equivalent are renamed.
+func TranslateExpr(expr string, table *Table) (string, error) {
+	tr, err := newExprTranslator(expr, table)
+	if err != nil {
+		return "", err
+	}
+	out := tr.translate(0, len(tr.toks))
+	if len(tr.issues) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(tr.issues, ", "))
+	}
+	return out, nil
+}
+
+// Find the relations a query selects from, their aliases and any CTEs, so
+// names can be resolved wherever they appear.
+func (tr *translator) scope() {
+	toks := tr.toks
+	for i, t := range toks {
+		if t.is("with") || (t.kind == tokComma && len(tr.ctes) > 0) {
+			// WITH name [(columns)] AS (
+			j := nextToken(toks, i)
+			if j < 0 || (toks[j].kind != tokIdent && toks[j].kind != tokQuoted) || isKeyword(toks[j]) {
+				continue
+			}
+			k := nextToken(toks, j)
+			if k >= 0 && toks[k].kind == tokLParen {
+				k = nextToken(toks, matchParen(toks, k))
+			}
+			if k >= 0 && toks[k].is("as") {
+				if l := nextToken(toks, k); l >= 0 && toks[l].kind == tokLParen {
+					tr.ctes[strings.ToLower(toks[j].name())] = true
+				}
+			}
+		}
+	}
+
+	for i, t := range toks {
+		if !t.is("from", "join", "update", "into") {
+			continue
+		}
+		for j := nextToken(toks, i); j >= 0; {
+			var rel *Table
+			end := j
+			switch {
+			case toks[j].kind == tokLParen:
+				if end = matchParen(toks, j); end < 0 {
+					return
+				}
+			case (toks[j].kind == tokIdent && !isKeyword(toks[j])) || toks[j].kind == tokQuoted:
+				parts, e := dottedName(toks, j)
+				end = e
+				// INSERT INTO name (columns) isn't a function
+				if k := nextToken(toks, end); k >= 0 && toks[k].kind == tokLParen && !t.is("into") {
+					tr.issue("selects from function %s", partNames(parts))
+					if end = matchParen(toks, k); end < 0 {
+						return
+					}
+					break
+				}
+				rel = tr.relation(parts)
+				tr.refs[j] = rel
+				if rel != nil {
+					name := strings.ToLower(parts[len(parts)-1].name())
+					text := quotePsql(rel.NewName)
+					if _, ok := tr.pseudo[name]; ok && len(parts) == 1 {
+						text = quotePsql(name)
+					}
+					tr.aliases[name] = alias{table: rel, text: text}
+				}
+			default:
+				j = -1
+				continue
+			}
+
+			k := nextToken(toks, end)
+			if k >= 0 && toks[k].is("as") {
+				k = nextToken(toks, k)
+			}
+			if k >= 0 && ((toks[k].kind == tokIdent && !isKeyword(toks[k])) || toks[k].kind == tokQuoted) {
+				tr.aliases[strings.ToLower(toks[k].name())] = alias{table: rel, text: quotePsql(strings.ToLower(toks[k].name()))}
+				k = nextToken(toks, k)
+			}
+			// Table hints such as WITH (NOLOCK) have no equivalent
+			if k >= 0 && toks[k].is("with") {
+				if l := nextToken(toks, k); l >= 0 && toks[l].kind == tokLParen {
+					if h := nextToken(toks, l); h >= 0 && toks[h].kind == tokIdent && !toks[h].is("select") {
+						end := matchParen(toks, l)
+						tr.skip[prevToken(toks, k)+1] = end
+						k = nextToken(toks, end)
+					}
+				}
+			}
+			j = -1
+			if k >= 0 && toks[k].kind == tokComma && t.is("from") {
+				j = nextToken(toks, k)
+			}
+		}
+	}
+
+	for _, rel := range tr.refs {
+		if rel != nil {
+			tr.tables = append(tr.tables, rel)
+		}
+	}
+}
+
+// Look up a relation by its one, two or three part name
+func (tr *translator) relation(parts []token) *Table {
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = strings.ToLower(p.name())
+	}
+	switch len(names) {
+	case 1:
+		if p, ok := tr.pseudo[names[0]]; ok {
+			return p.table
+		}
+		if tr.ctes[names[0]] {
+			return nil
+		}
+		if rel, ok := tr.relations[strings.ToLower(tr.schema)+"."+names[0]]; ok {
+			return rel
+		}
+		if rel, ok := tr.relations["dbo."+names[0]]; ok {
+			return rel
+		}
+	case 2:
+		if rel, ok := tr.relations[names[0]+"."+names[1]]; ok {
+			return rel
+		}
+	default:
+		tr.issue("%s is in another database", partNames(parts))
+		return nil
+	}
+	tr.issue("%s isn't being migrated", partNames(parts))
+	return nil
+}
+
+// A name and the dotted parts that follow it, eg [dbo].[Orders] or o.ID.
+// Returns the parts and the index of the last token.
+func dottedName(toks []token, i int) ([]token, int) {
+	parts := []token{toks[i]}
+	end := i
+	for end+2 < len(toks) && toks[end+1].kind == tokDot &&
+		(toks[end+2].kind == tokIdent || toks[end+2].kind == tokQuoted) {
+		end += 2
+		parts = append(parts, toks[end])
+	}
+	return parts, end
+}
+
+func partNames(parts []token) string {
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = p.name()
+	}
+	return strings.Join(names, ".")
+}
+
+// The index of the parenthesis closing the one at i, or -1
+func matchParen(toks []token, i int) int {
+	depth := 0
+	for ; i < len(toks); i++ {
+		switch toks[i].kind {
+		case tokLParen:
+			depth++
+		case tokRParen:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The index of the parenthesis opening the one at i, or -1
+func matchParenBack(toks []token, i int) int {
+	depth := 0
+	for ; i >= 0; i-- {
+		switch toks[i].kind {
+		case tokRParen:
+			depth++
+		case tokLParen:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The index of the next token that isn't whitespace, or -1
+func nextToken(toks []token, i int) int {
+	for i++; i < len(toks); i++ {
+		if toks[i].kind != tokSpace {
+			return i
+		}
+	}
+	return -1
+}
+
+// The index of the previous token that isn't whitespace, or -1
+func prevToken(toks []token, i int) int {
+	for i--; i >= 0; i-- {
+		if toks[i].kind != tokSpace {
+			return i
+		}
+	}
+	return -1
+}
+
+// Translate the tokens from lo up to hi
+func (tr *translator) translate(lo, hi int) string {
+	var out strings.Builder
+	limits := []string{""} // LIMITs from TOP waiting for the end of their query
+	for i := lo; i < hi; i++ {
+		if end, ok := tr.skip[i]; ok {
+			i = end
+			continue
+		}
+		t := tr.toks[i]
+		switch t.kind {
+		case tokString:
+			out.WriteString(strings.TrimLeft(t.text, "Nn"))
+		case tokLParen:
+			limits = append(limits, "")
+			out.WriteString(t.text)
+		case tokRParen:
+			if n := len(limits); n > 1 {
+				out.WriteString(limits[n-1])
+				limits = limits[:n-1]
+			}
+			out.WriteString(t.text)
+		case tokOp:
+			if t.text == "+" && tr.concatenates(i) {
+				out.WriteString("||")
+			} else {
+				out.WriteString(t.text)
+			}
+		case tokIdent, tokQuoted:
+			if isKeyword(t) {
+				if t.is("update") && tr.pseudo != nil {
+					if text, end, ok := tr.updated(i); ok {
+						out.WriteString(text)
+						i = end
+						continue
+					}
+				}
+				if t.is("top") {
+					if p := prevToken(tr.toks, i); p >= 0 && tr.toks[p].is("select", "distinct", "all") {
+						i = tr.top(i, hi, &limits[len(limits)-1])
+						continue
+					}
+				}
+				out.WriteString(tr.keyword(i, limits[len(limits)-1]))
+				continue
+			}
+			var text string
+			text, i = tr.name(i, hi)
+			out.WriteString(text)
+		default:
+			out.WriteString(t.text)
+		}
+	}
+	out.WriteString(limits[0])
+	return out.String()
+}
+
+// Keywords that need translating or can't be
+func (tr *translator) keyword(i int, limit string) string {
+	t := tr.toks[i]
+	prev := prevToken(tr.toks, i)
+	next := nextToken(tr.toks, i)
+	switch {
+	case t.is("union", "except", "intersect") && limit != "":
+		tr.issue("TOP in a query using %s", strings.ToUpper(t.text))
+	case t.is("apply") && prev >= 0 && tr.toks[prev].is("cross"):
+		return "JOIN LATERAL"
+	case t.is("apply"):
+		tr.issue("OUTER APPLY")
+	case t.is("pivot", "unpivot", "collate"):
+		tr.issue("%s", strings.ToUpper(t.text))
+	case t.is("for") && next >= 0 && tr.toks[next].is("xml", "json", "browse"):
+		tr.issue("FOR %s", strings.ToUpper(tr.toks[next].text))
+	case t.is("option") && next >= 0 && tr.toks[next].kind == tokLParen:
+		tr.issue("query hints")
+	case t.is("into") && tr.namer != nil && (prev < 0 || !tr.toks[prev].is("insert", "merge")):
+		tr.issue("SELECT INTO")
+	case t.is("user", "system_user"):
+		return "current_user"
+	}
+	return t.text
+}
+
+// TOP n becomes a LIMIT at the end of the query, returns the last token used
+func (tr *translator) top(i, hi int, limit *string) int {
+	j := nextToken(tr.toks, i)
+	if j < 0 || j >= hi {
+		return i
+	}
+	n := tr.toks[j].text
+	switch tr.toks[j].kind {
+	case tokNumber:
+	case tokLParen:
+		end := matchParen(tr.toks, j)
+		if end < 0 {
+			return i
+		}
+		n = strings.TrimSpace(tr.translate(j+1, end))
+		j = end
+	default:
+		tr.issue("TOP %s", n)
+		return i
+	}
+	*limit = " LIMIT " + n
+
+	if k := nextToken(tr.toks, j); k >= 0 && tr.toks[k].is("percent") {
+		// Often used to allow an ORDER BY in a view, which Postgres allows anyway
+		if n != "100" {
+			tr.issue("TOP %s PERCENT", n)
+		}
+		*limit = ""
+		j = k
+	}
+	if k := nextToken(tr.toks, j); k >= 0 && tr.toks[k].is("with") {
+		if l := nextToken(tr.toks, k); l >= 0 && tr.toks[l].is("ties") {
+			tr.issue("TOP WITH TIES")
+			j = l
+		}
+	}
+	if j+1 < hi && tr.toks[j+1].kind == tokSpace {
+		j++
+	}
+	return j
+}
+
+// Translate a name starting at token i, a function call, relation or
+// column, returning the translation and the last token used
+func (tr *translator) name(i, hi int) (string, int) {
+	t := tr.toks[i]
+	if v, ok := tr.vars[strings.ToLower(t.text)]; ok && t.kind == tokIdent {
+		return v.name, i
+	}
+	if t.kind == tokIdent && (strings.HasPrefix(t.text, "@") || strings.HasPrefix(t.text, "#")) {
+		tr.issue("uses %s", t.text)
+		return t.text, i
+	}
+	parts, end := dottedName(tr.toks, i)
+	if end >= hi {
+		parts, end = parts[:1], i
+	}
+
+	if _, ok := tr.refs[i]; ok {
+		if p, ok := tr.pseudo[strings.ToLower(t.name())]; ok && len(parts) == 1 {
+			return tr.pseudoFrom(p, t, end), end
+		}
+		// Looked up again so the issue is noted against whatever is being
+		// translated, rather than only when the query was scoped
+		if rel := tr.relation(parts); rel != nil {
+			return rel.PsqlName(), end
+		}
+		return tr.unknown(parts[len(parts)-1]), end
+	}
+
+	if next := nextToken(tr.toks, end); next >= 0 && next < hi && tr.toks[next].kind == tokLParen {
+		if close := matchParen(tr.toks, next); close >= 0 && close < hi && len(parts) == 1 && t.kind == tokIdent {
+			if text, ok := tr.call(strings.ToLower(t.text), next, close); ok {
+				return text, close
+			}
+		}
+		return tr.function(parts), end
+	}
+
+	text, c := tr.reference(parts)
+	if c != nil && c.kind() == kindBool {
+		boolComparison(tr.toks, end)
+	}
+	return text, end
+}
+
+// Selecting from a pseudo table. A row level trigger has its row in NEW or
+// OLD, which needs an alias as a subquery, and which is empty when the
+// trigger doesn't have it, eg deleted in an INSERT.
+func (tr *translator) pseudoFrom(p pseudoTable, t token, end int) string {
+	if p.row == "" {
+		return p.text
+	}
+	if k := nextToken(tr.toks, end); k >= 0 && (tr.toks[k].is("as") ||
+		(tr.toks[k].kind == tokIdent && !isKeyword(tr.toks[k])) || tr.toks[k].kind == tokQuoted) {
+		return p.text
+	}
+	return p.text + " AS " + quotePsql(strings.ToLower(t.name()))
+}
+
+// UPDATE(column) in a trigger, true when an INSERT or UPDATE set the
+// column. A row level trigger compares NEW and OLD, which also leaves out
+// columns set to the value they had. Returns the last token used.
+func (tr *translator) updated(i int) (string, int, bool) {
+	open := nextToken(tr.toks, i)
+	if open < 0 || tr.toks[open].kind != tokLParen {
+		return "", i, false
+	}
+	close := matchParen(tr.toks, open)
+	col := nextToken(tr.toks, open)
+	if close < 0 || col < 0 || nextToken(tr.toks, col) != close {
+		return "", i, false
+	}
+	p := tr.pseudo["inserted"]
+	name, _ := tr.columnOf(p.table, tr.toks[col])
+	if p.row == "" {
+		tr.issue("UPDATE(%s) in a statement level trigger, compare inserted and deleted instead", tr.toks[col].name())
+		return "UPDATE(" + name + ")", close, true
+	}
+	return fmt.Sprintf("(TG_OP = 'INSERT' OR (TG_OP = 'UPDATE' AND NEW.%s IS DISTINCT FROM OLD.%s))", name, name), close, true
+}
+
+// The name of a function that isn't translated specially
+func (tr *translator) function(parts []token) string {
+	if len(parts) > 1 {
+		tr.issue("calls function %s", partNames(parts))
+		names := make([]string, len(parts))
+		for i, p := range parts {
+			names[i] = tr.unknown(p)
+		}
+		return strings.Join(names, ".")
+	}
+	name := strings.ToLower(parts[0].text)
+	if pg, ok := exprFunctions[name]; ok {
+		return pg
+	}
+	if tr.namer != nil && !psqlFunctions[name] {
+		tr.issue("calls %s", strings.ToUpper(name))
+	}
+	return parts[0].text
+}
+
+// A column, alias or relation name
+func (tr *translator) reference(parts []token) (string, *Column) {
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = strings.ToLower(p.name())
+	}
+	switch len(parts) {
+	case 1:
+		if a, ok := tr.aliases[names[0]]; ok {
+			return a.text, nil
+		}
+		for _, t := range tr.tables {
+			if c := t.Column(names[0]); c != nil {
+				return c.PsqlName(), c
+			}
+		}
+		return tr.unknown(parts[0]), nil
+	case 2:
+		if a, ok := tr.aliases[names[0]]; ok {
+			text, c := tr.columnOf(a.table, parts[1])
+			return a.text + "." + text, c
+		}
+	case 3:
+		if rel, ok := tr.relations[names[0]+"."+names[1]]; ok {
+			text, c := tr.columnOf(rel, parts[2])
+			return rel.PsqlName() + "." + text, c
+		}
+	}
+	if len(parts) > 1 {
+		tr.issue("can't tell what %s refers to", partNames(parts))
+	}
+	out := make([]string, len(parts))
+	for i, p := range parts {
+		out[i] = tr.unknown(p)
+	}
+	return strings.Join(out, "."), nil
+}
+
+// A column of a relation. Only tables have their columns known, the columns
+// of views and derived tables are named like any other name.
+func (tr *translator) columnOf(rel *Table, part token) (string, *Column) {
+	if rel == nil || rel.Columns == nil {
+		return tr.unknown(part), nil
+	}
+	if c := rel.Column(part.name()); c != nil {
+		return c.PsqlName(), c
+	}
+	tr.issue("column %s.%s isn't being migrated", rel.OriginalName, part.name())
+	return tr.unknown(part), nil
+}
+
+// A name that isn't a known column or relation, such as a column alias or
+// CTE. In queries these go through the naming strategy like everything
+// else, in expressions only quoted names do.
+func (tr *translator) unknown(t token) string {
+	if tr.namer != nil {
+		return quotePsql(tr.namer.Name(t.name()))
+	}
+	if t.kind == tokQuoted {
+		return quotePsql(NameToPsql(t.name()))
+	}
+	return t.text
+}
+
+// Split a call's arguments into token ranges
+func (tr *translator) args(open, close int) [][2]int {
+	out := [][2]int{}
+	depth, start := 0, open+1
+	for i := open + 1; i < close; i++ {
+		switch tr.toks[i].kind {
+		case tokLParen:
+			depth++
+		case tokRParen:
+			depth--
+		case tokComma:
+			if depth == 0 {
+				out = append(out, [2]int{start, i})
+				start = i + 1
+			}
+		}
+	}
+	if nextToken(tr.toks, open) != close {
+		out = append(out, [2]int{start, close})
+	}
+	return out
+}
+
+func (tr *translator) arg(r [2]int) string {
+	return strings.TrimSpace(tr.translate(r[0], r[1]))
+}
+
+func (tr *translator) rawArg(r [2]int) string {
+	return strings.TrimSpace(joinTokens(tr.toks[r[0]:r[1]]))
+}
+
+// Calls that are translated as a whole, returns false for any other
+func (tr *translator) call(name string, open, close int) (string, bool) {
+	args := tr.args(open, close)
+	switch name {
+	case "cast", "try_cast":
+		if len(args) != 1 {
+			return "", false
+		}
+		as := -1
+		for i := args[0][0]; i < args[0][1]; i++ {
+			if tr.toks[i].is("as") {
+				as = i
+			}
+		}
+		if as < 0 {
+			return "", false
+		}
+		if name == "try_cast" {
+			tr.issue("TRY_CAST fails rather than giving NULL")
+		}
+		typ, _, err := psqlCastType(tr.rawArg([2]int{as + 1, close}))
+		if err != nil {
+			tr.issue("%s", err)
+		}
+		return fmt.Sprintf("CAST(%s AS %s)", tr.arg([2]int{args[0][0], as}), typ), true
+
+	case "convert", "try_convert":
+		if len(args) < 2 || len(args) > 3 {
+			return "", false
+		}
+		if name == "try_convert" {
+			tr.issue("TRY_CONVERT fails rather than giving NULL")
+		}
+		typ, kind, err := psqlCastType(tr.rawArg(args[0]))
+		if err != nil {
+			tr.issue("%s", err)
+		}
+		expr := tr.arg(args[1])
+		if len(args) == 3 {
+			style, err := strconv.Atoi(tr.rawArg(args[2]))
+			format, ok := convertStyles[style]
+			switch {
+			case err != nil:
+				tr.issue("CONVERT style %s", tr.rawArg(args[2]))
+			case ok && kind == kindText:
+				return fmt.Sprintf("to_char(%s, '%s')", expr, format), true
+			case ok && kind == kindTime:
+				return fmt.Sprintf("CAST(to_timestamp(%s, '%s') AS %s)", expr, format, typ), true
+			case style != 0 && style != 100:
+				tr.issue("CONVERT style %d", style)
+			}
+		}
+		return fmt.Sprintf("CAST(%s AS %s)", expr, typ), true
+
+	case "dateadd":
+		if len(args) != 3 {
+			return "", false
+		}
+		part := tr.datePart(args[0])
+		n, d := tr.arg(args[1]), tr.arg(args[2])
+		switch part {
+		case "quarter":
+			return fmt.Sprintf("(%s + (%s) * interval '3 months')", d, n), true
+		case "doy", "dow":
+			part = "day"
+		case "isoweek":
+			part = "week"
+		}
+		return fmt.Sprintf("(%s + (%s) * interval '1 %s')", d, n, part), true
+
+	case "datediff", "datediff_big":
+		if len(args) != 3 {
+			return "", false
+		}
+		a, b := tr.arg(args[1]), tr.arg(args[2])
+		switch tr.datePart(args[0]) {
+		case "year":
+			return fmt.Sprintf("(date_part('year', %s) - date_part('year', %s))::int", b, a), true
+		case "quarter":
+			return fmt.Sprintf("((date_part('year', %s) - date_part('year', %s)) * 4 + date_part('quarter', %s) - date_part('quarter', %s))::int", b, a, b, a), true
+		case "month":
+			return fmt.Sprintf("((date_part('year', %s) - date_part('year', %s)) * 12 + date_part('month', %s) - date_part('month', %s))::int", b, a, b, a), true
+		case "day", "doy", "dow":
+			return fmt.Sprintf("((%s)::date - (%s)::date)", b, a), true
+		case "week":
+			// Weeks start on Sunday, as they do in SQL Server by default
+			return fmt.Sprintf("((date_trunc('week', (%s)::date + 1)::date - date_trunc('week', (%s)::date + 1)::date) / 7)", b, a), true
+		case "hour":
+			return fmt.Sprintf("(extract(epoch from date_trunc('hour', %s) - date_trunc('hour', %s)) / 3600)::int", b, a), true
+		case "minute":
+			return fmt.Sprintf("(extract(epoch from date_trunc('minute', %s) - date_trunc('minute', %s)) / 60)::int", b, a), true
+		case "second":
+			return fmt.Sprintf("extract(epoch from date_trunc('second', %s) - date_trunc('second', %s))::int", b, a), true
+		case "millisecond":
+			return fmt.Sprintf("(extract(epoch from date_trunc('milliseconds', %s) - date_trunc('milliseconds', %s)) * 1000)::bigint", b, a), true
+		}
+		tr.issue("DATEDIFF by %s", tr.rawArg(args[0]))
+		return "", false
+
+	case "datepart", "year", "month", "day":
+		part := name
+		if name == "datepart" {
+			if len(args) != 2 {
+				return "", false
+			}
+			part = tr.datePart(args[0])
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return "", false
+		}
+		d := tr.arg(args[0])
+		switch part {
+		case "dow":
+			return fmt.Sprintf("(date_part('dow', %s) + 1)::int", d), true
+		case "week":
+			tr.issue("DATEPART(week) numbers weeks differently to Postgres")
+		case "isoweek":
+			part = "week"
+		case "millisecond":
+			return fmt.Sprintf("(date_part('milliseconds', %s)::int %% 1000)", d), true
+		}
+		return fmt.Sprintf("date_part('%s', %s)::int", part, d), true
+
+	case "iif":
+		if len(args) != 3 {
+			return "", false
+		}
+		return fmt.Sprintf("CASE WHEN %s THEN %s ELSE %s END", tr.arg(args[0]), tr.arg(args[1]), tr.arg(args[2])), true
+
+	case "charindex":
+		if len(args) != 2 {
+			return "", false
+		}
+		return fmt.Sprintf("strpos(%s, %s)", tr.arg(args[1]), tr.arg(args[0])), true
+
+	case "space":
+		if len(args) != 1 {
+			return "", false
+		}
+		return fmt.Sprintf("repeat(' ', %s)", tr.arg(args[0])), true
+
+	case "square":
+		if len(args) != 1 {
+			return "", false
+		}
+		return fmt.Sprintf("power(%s, 2)", tr.arg(args[0])), true
+
+	case "log":
+		switch len(args) {
+		case 1:
+			return fmt.Sprintf("ln(%s)", tr.arg(args[0])), true
+		case 2:
+			// The base comes first in Postgres, which only has it for numeric
+			return fmt.Sprintf("log((%s)::numeric, (%s)::numeric)", tr.arg(args[1]), tr.arg(args[0])), true
+		}
+		return "", false
+	}
+
+	if pg, ok := exprNiladic[name]; ok && len(args) == 0 {
+		return pg, true
+	}
+	return "", false
+}
+
+func (tr *translator) datePart(r [2]int) string {
+	raw := tr.rawArg(r)
+	if part, ok := dateParts[strings.ToLower(strings.Trim(raw, `[]"'`))]; ok {
+		return part
+	}
+	tr.issue("date part %s", raw)
+	return raw
+}
+
+// The Postgres type for a type named in CAST or CONVERT, eg nvarchar(50)
+func psqlCastType(s string) (string, valueKind, error) {
+	name, args := strings.ToLower(strings.TrimSpace(s)), ""
+	if i := strings.Index(name, "("); i >= 0 && strings.HasSuffix(name, ")") {
+		name, args = strings.TrimSpace(name[:i]), name[i+1:len(name)-1]
+	}
+	name = strings.Trim(name, "[]")
+	m, ok := typeMap[name]
+	if !ok {
+		return s, kindOther, fmt.Errorf("can't translate type %s", s)
+	}
+
+	// The defaults when no size is given
+	col := MSSqlColumn{TYPE_NAME: name, PRECISION: 30, SCALE: 7}
+	switch name {
+	case "decimal", "numeric":
+		col.PRECISION, col.SCALE = 18, 0
+	case "float":
+		col.PRECISION = 53
+	}
+	if args != "" {
+		sizes := strings.Split(args, ",")
+		if strings.TrimSpace(sizes[0]) == "max" {
+			col.PRECISION = 0
+		} else if p, err := strconv.Atoi(strings.TrimSpace(sizes[0])); err == nil {
+			col.PRECISION, col.SCALE = p, 0
+			if name == "time" || name == "datetime2" || name == "datetimeoffset" {
+				col.SCALE = p
+			}
+		}
+		if len(sizes) > 1 {
+			if s, err := strconv.Atoi(strings.TrimSpace(sizes[1])); err == nil {
+				col.SCALE = s
+			}
+		}
+	}
+	return m.psql(&col), m.kind, nil
+}
+
+// Whether the + at token i joins strings rather than adding numbers, going
+// by the rest of the expression it's part of
+func (tr *translator) concatenates(i int) bool {
+	lo, hi := tr.chain(i)
+	return tr.anyText(lo, hi)
+}
+
+// The run of operands and arithmetic either side of token i
+func (tr *translator) chain(i int) (int, int) {
+	operand := func(j int) bool {
+		t := tr.toks[j]
+		switch t.kind {
+		case tokSpace, tokString, tokNumber, tokQuoted, tokDot:
+			return true
+		case tokOp:
+			return len(t.text) == 1 && strings.Contains("+-*/%", t.text)
+		case tokIdent:
+			next := nextToken(tr.toks, j)
+			return !isKeyword(t) || (next >= 0 && tr.toks[next].kind == tokLParen)
+		}
+		return false
+	}
+	lo := i - 1
+	for ; lo >= 0; lo-- {
+		if tr.toks[lo].kind == tokRParen {
+			if lo = matchParenBack(tr.toks, lo); lo < 0 {
+				break
+			}
+			continue
+		}
+		if !operand(lo) {
+			break
+		}
+	}
+	hi := i + 1
+	for ; hi < len(tr.toks); hi++ {
+		if tr.toks[hi].kind == tokLParen {
+			if hi = matchParen(tr.toks, hi); hi < 0 {
+				hi = len(tr.toks)
+				break
+			}
+			continue
+		}
+		if !operand(hi) {
+			break
+		}
+	}
+	return lo + 1, hi
+}
+
+// Whether any operand of the +s from lo up to hi is text
+func (tr *translator) anyText(lo, hi int) bool {
+	depth, start := 0, lo
+	for i := lo; i <= hi; i++ {
+		if i < hi {
+			switch tr.toks[i].kind {
+			case tokLParen:
+				depth++
+				continue
+			case tokRParen:
+				depth--
+				continue
+			}
+			if depth > 0 || tr.toks[i].kind != tokOp || tr.toks[i].text != "+" {
+				continue
+			}
+		}
+		if tr.isText(start, i) {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+// Whether the operand from lo up to hi is text
+func (tr *translator) isText(lo, hi int) bool {
+	for lo < hi && tr.toks[lo].kind == tokSpace {
+		lo++
+	}
+	for hi > lo && tr.toks[hi-1].kind == tokSpace {
+		hi--
+	}
+	if lo >= hi {
+		return false
+	}
+	depth := 0
+	for i := lo; i < hi; i++ {
+		switch t := tr.toks[i]; t.kind {
+		case tokLParen:
+			depth++
+		case tokRParen:
+			depth--
+		case tokOp:
+			if depth == 0 && t.text != "+" {
+				return false
+			}
+		}
+	}
+
+	first := tr.toks[lo]
+	if v, ok := tr.vars[strings.ToLower(first.text)]; ok && hi-lo == 1 {
+		return v.kind == kindText
+	}
+	switch first.kind {
+	case tokString:
+		return hi-lo == 1
+	case tokLParen:
+		if matchParen(tr.toks, lo) == hi-1 {
+			return tr.anyText(lo+1, hi-1)
+		}
+	case tokIdent, tokQuoted:
+		parts, end := dottedName(tr.toks, lo)
+		next := nextToken(tr.toks, end)
+		if next >= 0 && next < hi && tr.toks[next].kind == tokLParen && matchParen(tr.toks, next) == hi-1 {
+			return tr.returnsText(strings.ToLower(first.text), next, hi-1)
+		}
+		if end != hi-1 {
+			return false
+		}
+		_, c := tr.lookup(parts)
+		return c != nil && c.kind() == kindText
+	}
+	return false
+}
+
+func (tr *translator) returnsText(name string, open, close int) bool {
+	args := tr.args(open, close)
+	if len(args) == 0 {
+		return false
+	}
+	switch name {
+	case "cast", "try_cast":
+		for i := args[0][0]; i < args[0][1]; i++ {
+			if tr.toks[i].is("as") {
+				_, kind, _ := psqlCastType(tr.rawArg([2]int{i + 1, close}))
+				return kind == kindText
+			}
+		}
+	case "convert", "try_convert":
+		_, kind, _ := psqlCastType(tr.rawArg(args[0]))
+		return kind == kindText
+	case "isnull", "coalesce", "nullif", "min", "max":
+		return tr.anyText(args[0][0], args[0][1])
+	case "iif":
+		return len(args) > 1 && tr.anyText(args[1][0], args[1][1])
+	}
+	return textFunctions[name]
+}
+
+// Find the column a name refers to without translating it
+func (tr *translator) lookup(parts []token) (*Table, *Column) {
+	switch len(parts) {
+	case 1:
+		for _, t := range tr.tables {
+			if c := t.Column(parts[0].name()); c != nil {
+				return t, c
+			}
+		}
+	case 2:
+		if a, ok := tr.aliases[strings.ToLower(parts[0].name())]; ok && a.table != nil {
+			return a.table, a.table.Column(parts[1].name())
+		}
+	case 3:
+		if rel, ok := tr.relations[strings.ToLower(parts[0].name()+"."+parts[1].name())]; ok {
+			return rel, rel.Column(parts[2].name())
+		}
+	}
+	return nil, nil
+}
+
+// Turn the 0 or 1 in "bitcol = 1" or "bitcol <> (0)" into FALSE/TRUE
+func boolComparison(toks []token, i int) {
+	op := nextToken(toks, i)
+	if op < 0 || toks[op].kind != tokOp || (toks[op].text != "=" && toks[op].text != "<>" && toks[op].text != "!=") {
+		return
+	}
+	k := nextToken(toks, op)
+	for k >= 0 && toks[k].kind == tokLParen {
+		k = nextToken(toks, k)
+	}
+	if k < 0 || toks[k].kind != tokNumber {
+		return
+	}
+	switch toks[k].text {
+	case "0":
+		toks[k].text = "FALSE"
+	case "1":
+		toks[k].text = "TRUE"
+	}
+}
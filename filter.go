@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// TABLESAMPLE sizes, eg "10 PERCENT" or "5000 ROWS"
+var sampleSize = regexp.MustCompile(`(?i)^\s*\d+(\.\d+)?\s+(percent|rows)\s*$`)
+
+func checkSample(sample string) error {
+	if sample != "" && !sampleSize.MatchString(sample) {
+		return fmt.Errorf("bad sample %q, expected N PERCENT or N ROWS", sample)
+	}
+	return nil
+}
+
+// Apply a table's row filter and column lists. Primary key columns are always
+// kept, without them the rows couldn't be told apart.
+func setFilter(t *Table, o TableOptions) {
+	t.Where = o.Where
+	t.Sample = o.Sample
+	t.Top = o.Top
+	if len(o.IncludeColumns) == 0 && len(o.ExcludeColumns) == 0 {
+		return
+	}
+
+	pk := []string{}
+	inPK := map[string]bool{}
+	for _, c := range t.PrimaryKey {
+		pk = append(pk, c.OriginalName)
+		inPK[c.OriginalName] = true
+	}
+	cols := []Column{}
+	for _, c := range t.Columns {
+		keep := (len(o.IncludeColumns) == 0 || containsFold(o.IncludeColumns, c.OriginalName)) &&
+			!containsFold(o.ExcludeColumns, c.OriginalName)
+		if !keep && inPK[c.OriginalName] {
+			// Only the original name is known yet, the table is renamed later
+			log.Printf("Warning: keeping %s.%s.%s, it's part of the primary key", t.OriginalSchema, t.OriginalName, c.OriginalName)
+			keep = true
+		}
+		if keep {
+			cols = append(cols, c)
+		}
+	}
+	t.Columns = cols
+
+	t.PrimaryKey = nil
+	for _, name := range pk {
+		t.PrimaryKey = append(t.PrimaryKey, t.Column(name))
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether only some of the table's rows are copied
+func (t *Table) Filtered() bool {
+	return t.Where != "" || t.Sample != "" || t.Top > 0
+}
+
+// What to read the table's rows from in SQL Server. A filtered table is read
+// through a derived table so the copy, chunking and verify all see the same
+// rows. Samples are REPEATABLE for the same reason, as long as the table
+// doesn't change in between.
+func (t *Table) MSSqlFrom() string {
+	if !t.Filtered() {
+		return t.MSSqlName()
+	}
+	out := "SELECT "
+	if t.Top > 0 {
+		out += fmt.Sprintf("TOP %d ", t.Top)
+	}
+	out += "* FROM " + t.MSSqlName()
+	if t.Sample != "" {
+		out += fmt.Sprintf(" TABLESAMPLE (%s) REPEATABLE (1)", strings.TrimSpace(t.Sample))
+	}
+	if t.Where != "" {
+		out += " WHERE " + t.Where
+	}
+	if t.Top > 0 && len(t.PrimaryKey) > 0 {
+		pk := make([]string, len(t.PrimaryKey))
+		for i, c := range t.PrimaryKey {
+			pk[i] = c.MSSqlName()
+		}
+		out += " ORDER BY " + strings.Join(pk, ", ")
+	}
+	return fmt.Sprintf("(%s) AS %s", out, quoteMSSql(t.OriginalName))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// A non primary key index, or a UNIQUE constraint which SQL Server backs with
+// an index. Apart from NewName all names are the original MS Sql Server names.
+type Index struct {
+	Name       string
+	NewName    string
+	Unique     bool
+	Constraint bool // Declared as a UNIQUE constraint rather than an index
+	Columns    []IndexColumn
+	Include    []string
+	Filter     string // WHERE clause of a filtered index
+}
+
+type IndexColumn struct {
+	Name       string
+	Descending bool
+}
+
+type CheckConstraint struct {
+	Name       string
+	NewName    string
+	Definition string
+	NotTrusted bool // Added WITH NOCHECK, existing rows may not satisfy it
+}
+
+// Read the clustered and non-clustered indexes on a table other than the
+// primary key. Columnstore, XML and spatial indexes have no equivalent and are
+// left out.
+func getIndexes(table Table, db *sql.DB) []Index {
+	rows, err := db.Query(`SELECT i.name, i.is_unique, i.is_unique_constraint, ISNULL(i.filter_definition, ''),
+			c.name, ic.is_descending_key, ic.is_included_column
+		FROM sys.indexes i
+		JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+		JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+		WHERE i.object_id = OBJECT_ID(?) AND i.type IN (1, 2)
+			AND i.is_primary_key = 0 AND i.is_hypothetical = 0 AND i.is_disabled = 0
+		ORDER BY i.name, ic.is_included_column, ic.key_ordinal, ic.index_column_id`, table.MSSqlName())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []Index{}
+	defer rows.Close()
+	for rows.Next() {
+		var ix Index
+		var col string
+		var desc, included bool
+		if err := rows.Scan(&ix.Name, &ix.Unique, &ix.Constraint, &ix.Filter, &col, &desc, &included); err != nil {
+			log.Fatal(err)
+		}
+		if len(out) == 0 || out[len(out)-1].Name != ix.Name {
+			out = append(out, ix)
+		}
+		last := &out[len(out)-1]
+		if included {
+			last.Include = append(last.Include, col)
+		} else {
+			last.Columns = append(last.Columns, IndexColumn{Name: col, Descending: desc})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// Read the enabled check constraints on a table
+func getCheckConstraints(table Table, db *sql.DB) []CheckConstraint {
+	rows, err := db.Query(`SELECT name, definition, is_not_trusted
+		FROM sys.check_constraints
+		WHERE parent_object_id = OBJECT_ID(?) AND is_disabled = 0
+		ORDER BY name`, table.MSSqlName())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []CheckConstraint{}
+	defer rows.Close()
+	for rows.Next() {
+		var ck CheckConstraint
+		if err := rows.Scan(&ck.Name, &ck.Definition, &ck.NotTrusted); err != nil {
+			log.Fatal(err)
+		}
+		out = append(out, ck)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"unicode"
+	"sort"
+	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
@@ -14,116 +16,375 @@ import (
 )
 
 type Table struct {
-	OriginalName string
-	NewName      string
-	Columns      []Column
-	PrimaryKey   []*Column
-	ForiegnKeys  []ForeignKey
+	OriginalSchema string
+	OriginalName   string
+	NewSchema      string
+	NewName        string
+	Columns        []Column
+	PrimaryKey     []*Column
+	ForeignKeys    []ForeignKey
+	Indexes        []Index
+	Checks         []CheckConstraint
+	Computed       []ComputedColumn // Not copied, Postgres computes them
+	Where          string           // Only copy rows matching this T-SQL condition
+	Sample         string           // Only copy a TABLESAMPLE of this size
+	Top            int64            // Only copy the first Top rows by primary key
+	Sync           string           // Column sync finds changed rows by, if not the rowversion
 }
 
 type Column struct {
 	OriginalName string
 	NewName      string
+	Identity     *Identity
+	Type         string   // Postgres type replacing the one PostgresType picks
+	Transforms   []string // Names of the transforms values go through
 	col          *MSSqlColumn
 }
 
+// The seed and increment of an IDENTITY column
+type Identity struct {
+	Seed      int64
+	Increment int64
+}
+
+// A foreign key constraint. Apart from NewName all names are the original MS
+// Sql Server names and get mapped to the new names when the SQL is generated.
 type ForeignKey struct {
+	Name       string
+	NewName    string
+	Columns    []string
+	RefSchema  string
+	RefTable   string
+	RefColumns []string
+	OnUpdate   string
+	OnDelete   string
 }
 
 type config struct {
-	from   string
-	to     string
-	tables []string
-	drop   bool
-	print  bool
+	command      string
+	configFile   string
+	from         string
+	to           string
+	tables       []string
+	all          bool
+	schema       string
+	schemaMap    SchemaMap
+	namer        *Namer
+	include      []string
+	exclude      []string
+	drop         bool
+	print        bool
+	copy         CopyOptions
+	jobs         int
+	chunkRows    int64
+	stateFile    string
+	resume       bool
+	maxErrors    int
+	rejectFile   string
+	hash         bool
+	maxDiffs     int
+	interval     time.Duration
+	syncOverlap  time.Duration
+	changes      string
+	output       string
+	format       string
+	gzip         bool
+	views        bool
+	report       string
+	triggers     bool
+	triggerLevel string
+	computed     string
+
+	// Per table options keyed by lower case schema.table
+	tableOptions map[string]TableOptions
 }
 
 func main() {
 	cfg := getArgs()
 
+	if cfg.command == "import" {
+		runImport(cfg)
+		return
+	}
 	msDB := ConnectAndTest("mssql", cfg.from)
+	if cfg.command == "config" {
+		runValidateConfig(cfg, msDB)
+		return
+	}
+	tables := loadTables(cfg, msDB)
+	views := loadViews(cfg, msDB, tables)
+	triggers := loadTriggers(cfg, msDB, tables, views)
+
+	if cfg.command == "verify" {
+		runVerify(cfg, msDB, tables)
+		return
+	}
+	if cfg.command == "sync" {
+		runSync(cfg, msDB, tables)
+		return
+	}
+	if cfg.command == "export-schema" {
+		runExportSchema(cfg, tables, views, triggers)
+		return
+	}
+	if cfg.command == "replicate" {
+		runReplicate(cfg, msDB, tables)
+		return
+	}
+	if cfg.command == "convert-routines" {
+		runConvertRoutines(cfg, msDB, tables, views)
+		return
+	}
+	if cfg.command == "export" {
+		runExport(cfg, msDB, tables, views, triggers)
+		return
+	}
+
+	if cfg.print {
+		printSql(tables, views, triggers)
+		return
+	}
+
+	state := NewState(cfg.stateFile)
+	if cfg.resume {
+		var err error
+		if state, err = LoadState(cfg.stateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
+	if cfg.maxErrors > 0 {
+		rejects, err := OpenRejectLog(cfg.rejectFile, cfg.maxErrors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rejects.Close()
+		cfg.copy.Rejects = rejects
+	}
+
+	psqlDB := ConnectAndTest("postgres", cfg.to)
+	migrate(cfg, msDB, psqlDB, tables, state)
+	createViews(psqlDB, views)
+	createTriggers(psqlDB, triggers)
+	reportReview(cfg, append(viewReview(views), triggerReview(triggers)...))
+
+	if cfg.copy.Rejects != nil && cfg.copy.Rejects.Count() > 0 {
+		log.Printf("Rejected %d rows, see %s", cfg.copy.Rejects.Count(), cfg.rejectFile)
+	}
+}
+
+// Read the definitions of every table being migrated, in the order they
+// should be loaded.
+func loadTables(cfg config, msDB *sql.DB) []Table {
 	tables := []Table{}
+	for _, tt := range describeTables(cfg, msDB) {
+		if _, err := tt.CreateSql(); err != nil {
+			log.Printf("Skipping  %s: %s", tt.Key(), err)
+			continue
+		}
+		tables = append(tables, tt)
+	}
+
+	if problems := checkNames(tables); len(problems) > 0 {
+		for _, p := range problems {
+			log.Println(p)
+		}
+		log.Fatal(`Conflicting names, rename tables, columns, indexes or constraints with "name", "columns", "indexes" or "constraints" in --name-map`)
+	}
+	return sortByDependencies(tables)
+}
+
+// Read the tables named on the command line or found with --all from SQL
+// Server and give them their new names.
+func describeTables(cfg config, msDB *sql.DB) []Table {
+	names := []tableName{}
+	if cfg.all {
+		names = discoverTables(msDB, cfg.schema)
+	}
+	for _, t := range cfg.tables {
+		name, err := parseTableName(t, cfg.schema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = filterTables(names, cfg.include, cfg.exclude)
+	if cfg.computed != ComputedGenerated && cfg.computed != ComputedView {
+		log.Fatalf("unknown computed column mode %q, expected generated or view", cfg.computed)
+	}
 
-	for _, table := range cfg.tables {
-		cols := getColumns(table, msDB)
+	tables := []Table{}
+	for _, name := range names {
 		tt := Table{
-			OriginalName: table,
-			NewName:      NameToPsql(table),
-			Columns:      cols,
+			OriginalSchema: name.Schema,
+			OriginalName:   name.Name,
+			NewSchema:      cfg.schemaMap.Target(name.Schema, cfg.namer.Name),
+		}
+		tt.Columns = getColumns(tt, msDB)
+		if len(tt.Columns) == 0 {
+			log.Printf("Skipping  %s: no such table", name)
+			continue
 		}
-		tables = append(tables, tt)
 
+		getIdentity(tt, msDB)
 		tt.PrimaryKey = getPrimaryKeys(tt, msDB)
+		tt.ForeignKeys = getForeignKeys(tt, msDB)
+		tt.Indexes = getIndexes(tt, msDB)
+		tt.Checks = getCheckConstraints(tt, msDB)
+		opts := cfg.tableOptions[strings.ToLower(name.String())]
+		setFilter(&tt, opts)
+		cfg.namer.Rename(&tt)
+		setColumnOptions(&tt, opts)
+		setComputed(&tt, getComputedColumns(tt, msDB), cfg.computed)
+		tables = append(tables, tt)
+	}
+	uniqueIndexNames(tables)
+	return tables
+}
 
-		//for _, p := range tt.PrimaryKey {
-		//	log.Printf("%#v", p)
-		//}
-		//log.Println(tt.CreateSql())
-
-		if cfg.print {
-			fmt.Println(tt.CreateSql())
-		} else {
-			psqlDB := ConnectAndTest("postgres", cfg.to)
-
-			if cfg.drop {
-				log.Println("Dropping  ", tt.NewName)
-				if _, err := psqlDB.Exec(tt.DropSql()); err != nil {
-					log.Fatal(err)
-				}
+func printSql(tables []Table, views []View, triggers []Trigger) {
+	for _, s := range createSchemaSql(tables) {
+		fmt.Println(s)
+	}
+	for _, tt := range tables {
+		createSql, _ := tt.CreateSql()
+		fmt.Println(createSql)
+		if viewSql := tt.ComputedViewSql(); viewSql != "" {
+			fmt.Println(viewSql)
+		}
+	}
+	for _, tt := range tables {
+		for _, s := range tt.IndexSql() {
+			fmt.Println(s)
+		}
+	}
+	for _, tt := range tables {
+		for _, fk := range tt.ForeignKeys {
+			fkSql, err := fk.CreateSql(&tt, tables)
+			if err != nil {
+				log.Printf("Skipping  foreign key %s: %s", fk.Name, err)
+				continue
 			}
+			fmt.Println(fkSql)
+		}
+	}
+	for _, v := range views {
+		if len(v.Issues) > 0 {
+			log.Printf("Skipping  view %s: needs review", v.Key())
+			continue
+		}
+		fmt.Println(v.Sql)
+	}
+	for _, t := range triggers {
+		if len(t.Issues) > 0 {
+			log.Printf("Skipping  trigger %s: needs review", t.Key())
+			continue
+		}
+		for _, s := range t.statements() {
+			fmt.Println(s)
+		}
+	}
+}
+
+// Create, load and constrain the tables, recording progress in state as it
+// goes and skipping anything state says is already done.
+func migrate(cfg config, msDB, psqlDB *sql.DB, tables []Table, state *State) {
+	for _, s := range createSchemaSql(tables) {
+		if _, err := psqlDB.Exec(s); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, tt := range tables {
+		ts := state.Table(tt.Key())
+		if ts.Created {
+			continue
+		}
 
-			log.Println("Createing ", tt.NewName)
-			if _, err := psqlDB.Exec(tt.CreateSql()); err != nil {
+		if cfg.drop {
+			log.Println("Dropping  ", tt.Key())
+			if _, err := psqlDB.Exec(tt.DropSql()); err != nil {
 				log.Fatal(err)
 			}
+		}
 
-			log.Println("Copying   ", tt.NewName)
-			if err := CopyTable(msDB, psqlDB, tt); err != nil {
+		log.Println("Createing ", tt.Key())
+		createSql, _ := tt.CreateSql()
+		if _, err := psqlDB.Exec(createSql); err != nil {
+			log.Fatal(err)
+		}
+		if viewSql := tt.ComputedViewSql(); viewSql != "" {
+			if _, err := psqlDB.Exec(viewSql); err != nil {
 				log.Fatal(err)
 			}
 		}
-
+		if err := state.Update(func() { ts.Created = true }); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-}
-
-func CopyTable(from, to *sql.DB, table Table) error {
-	tx, err := to.Begin()
-	if err != nil {
-		return err
+	for _, tt := range tables {
+		if err := recordSyncStart(msDB, tt, state); err != nil {
+			log.Fatalf("%s: %s", tt.Key(), err)
+		}
+	}
+	if err := recordReplicationStart(msDB, tables, state); err != nil {
+		log.Fatal(err)
 	}
 
-	rows, err := from.Query(table.SelectMSSql())
-	if err != nil {
+	jobs := planJobs(msDB, tables, cfg.chunkRows, state, cfg.resume)
+	if err := runJobs(cfg, jobs, state); err != nil {
 		log.Fatal(err)
 	}
 
-	rr := make([]interface{}, len(table.Columns))
-	ra := make([]interface{}, len(table.Columns))
-	for i, _ := range ra {
-		ra[i] = &rr[i]
+	for _, tt := range tables {
+		if resetSql := tt.ResetIdentitySql(); resetSql != "" {
+			log.Println("Resetting ", tt.Key())
+			if _, err := psqlDB.Exec(resetSql); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	count := 0
-	for rows.Next() {
-		count++
-		rows.Scan(ra...)
-		_, err := tx.Exec(table.InsertPsql(), rr...)
-		if err != nil {
-			log.Println(err)
+	// Indexes are quicker to build once the data is in, and the unique ones
+	// need to be there before the foreign keys that reference them
+	for _, tt := range tables {
+		ts := state.Table(tt.Key())
+		if ts.Indexes {
+			continue
+		}
+		for _, s := range tt.IndexSql() {
+			log.Println("Indexing  ", tt.Key(), s)
+			if _, err := psqlDB.Exec(s); err != nil {
+				log.Printf("Warning: %s: %s", tt.Key(), err)
+			}
 		}
-		if count%100 == 0 {
-			log.Print(count)
+		if err := state.Update(func() { ts.Indexes = true }); err != nil {
+			log.Fatal(err)
 		}
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
+
+	// Foreign keys go on last so the data can be loaded in any order
+	for _, tt := range tables {
+		ts := state.Table(tt.Key())
+		if ts.ForeignKeys {
+			continue
+		}
+		for _, fk := range tt.ForeignKeys {
+			fkSql, err := fk.CreateSql(&tt, tables)
+			if err != nil {
+				log.Printf("Skipping  foreign key %s: %s", fk.Name, err)
+				continue
+			}
+			log.Println("Adding    ", fk.Name)
+			if _, err := psqlDB.Exec(fkSql); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := state.Update(func() { ts.ForeignKeys = true }); err != nil {
+			log.Fatal(err)
+		}
 	}
-	log.Printf("Copied %d rows", count)
-	rows.Close()
-	return nil
 }
 
 func ConnectAndTest(driverName, dataSourceName string) *sql.DB {
@@ -137,33 +398,152 @@ func ConnectAndTest(driverName, dataSourceName string) *sql.DB {
 	return db
 }
 
-const usage = `mssql_migrate [--drop] [--print] <from> <to> <table> [table ...]`
+const usage = `mssql_migrate [command] [options] <from> <to> <table> [table ...]
+       mssql_migrate [command] [options] --all <from> <to>
+       mssql_migrate [command] --config <file> [options]
+       mssql_migrate export [options] <from> <dir> <table> [table ...]
+       mssql_migrate import [options] <dir> <to>
+       mssql_migrate convert-routines [options] <from> <file> [table ...]
+
+Commands:
+  migrate          Create and copy the tables (the default)
+  verify           Compare the copied tables against the originals
+  sync             Upsert the rows changed since the last migrate or sync
+  replicate        Apply CDC changes to Postgres until stopped
+  export-schema    Write the Postgres DDL to a file for review
+  export           Write the tables' rows and DDL to a directory
+  import           Load a directory written by export into Postgres
+  convert-routines Write PL/pgSQL versions of the procedures and functions
+  config validate  Check the configuration against the source database
+
+Options:`
+
+// The first argument can name one of these, otherwise it's a migrate
+var commands = map[string]bool{
+	"migrate":          true,
+	"verify":           true,
+	"sync":             true,
+	"replicate":        true,
+	"export-schema":    true,
+	"export":           true,
+	"import":           true,
+	"convert-routines": true,
+	"config":           true,
+}
 
 func getArgs() config {
-	cfg := config{}
+	cfg := config{command: "migrate"}
 
+	args := os.Args[1:]
+	if len(args) > 0 && commands[args[0]] {
+		cfg.command = args[0]
+		args = args[1:]
+	}
+	if cfg.command == "config" {
+		if len(args) == 0 || args[0] != "validate" {
+			fmt.Println("Usage: ", usage)
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
+
+	flag.StringVar(&cfg.configFile, "config", "", "JSON or YAML file to read the migration's options from, options given on the command line take precedence")
 	flag.BoolVar(&cfg.drop, "drop", false, "Drop tables before creating them")
 	flag.BoolVar(&cfg.print, "print", false, "Dont execute, only print the creation SQL")
+	flag.BoolVar(&cfg.all, "all", false, "Migrate every table in the schema")
+	flag.StringVar(&cfg.schema, "schema", "dbo", "Schema to look for tables in with --all, and for tables named without one")
+	schemaMap := flag.StringSlice("schema-map", nil, "Postgres schema each source schema goes to, as src=dst pairs")
+	naming := flag.String("naming", "snake", "How names are converted: snake, lower, preserve or quoted")
+	nameMap := flag.String("name-map", "", "JSON file giving new names for individual tables, columns, indexes and constraints")
+	flag.StringSliceVar(&cfg.include, "include", nil, "Only migrate tables matching these glob patterns")
+	flag.StringSliceVar(&cfg.exclude, "exclude", nil, "Don't migrate tables matching these glob patterns")
+	flag.StringVar(&cfg.copy.Mode, "insert-mode", InsertModeCopy, "How rows are written: insert, copy or multirow")
+	flag.IntVar(&cfg.copy.BatchSize, "batch-size", 10000, "Rows written per transaction")
+	flag.IntVarP(&cfg.jobs, "jobs", "j", 1, "Number of tables (or chunks of tables) to copy at once")
+	flag.StringVar(&cfg.stateFile, "state", "mssql_migrate.state.json", "File to checkpoint progress to")
+	flag.BoolVar(&cfg.resume, "resume", false, "Pick up a failed run from the --state file")
+	flag.IntVar(&cfg.maxErrors, "max-errors", 0, "Rows that may fail before giving up, 0 stops at the first bad row")
+	flag.StringVar(&cfg.rejectFile, "reject-file", "mssql_migrate.rejects.jsonl", "File rows that failed are written to with --max-errors, CSV if it ends in .csv")
+	flag.Int64Var(&cfg.chunkRows, "chunk-rows", 1000000, "Split tables with more rows than this into primary key ranges, 0 to never split")
+	flag.BoolVar(&cfg.hash, "hash", false, "With verify, compare hashes of every chunk of rows as well as the aggregates")
+	flag.IntVar(&cfg.maxDiffs, "max-diffs", 100, "With verify --hash, the most differing rows to report per chunk")
+	flag.DurationVar(&cfg.interval, "interval", 0, "With sync, sync again after this long until stopped, eg 30s. With replicate, how often to look for changes, default 10s")
+	flag.DurationVar(&cfg.syncOverlap, "sync-overlap", time.Minute, "With sync, how far before a date mark to look again for rows committed late")
+	flag.StringVar(&cfg.output, "output", "schema.sql", "With export-schema, the file to write, or a directory to write a file per section into")
+	flag.BoolVar(&cfg.views, "views", false, "Also migrate the views in the tables' schemas")
+	flag.BoolVar(&cfg.triggers, "triggers", false, "Also migrate the triggers on the tables and views")
+	flag.StringVar(&cfg.triggerLevel, "trigger-level", TriggerLevelStatement, "What AFTER triggers fire for: statement, with inserted and deleted as transition tables, or row, with them as NEW and OLD")
+	flag.StringVar(&cfg.computed, "computed", ComputedGenerated, "Where computed columns that aren't persisted go: generated, as stored generated columns, or view, in a view of the table named <table>_computed")
+	flag.StringVar(&cfg.report, "report", "mssql_migrate.review.txt", "File views, routines and triggers that need translating by hand are written to")
+	flag.StringVar(&cfg.format, "format", DumpFormatText, "With export, the data file format: text (COPY's own) or csv")
+	flag.BoolVar(&cfg.gzip, "gzip", false, "With export, compress the data files")
+	flag.StringVar(&cfg.changes, "changes", "", "With replicate, apply a recorded change set from this JSON lines file instead of reading CDC")
 	flag.Usage = func() {
 		fmt.Println("Usage: ", usage)
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
-	args := flag.Args()
-	if len(args) < 3 {
+	file := configFile{}
+	var err error
+	if cfg.configFile != "" {
+		if file, err = loadConfigFile(cfg.configFile, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Arguments replace the file's from, to and tables
+	args = flag.Args()
+	if len(args) > 0 {
+		file.from, file.to, file.tables = args[0], "", nil
+	}
+	if len(args) > 1 {
+		file.to = args[1]
+	}
+	if len(args) > 2 {
+		file.tables = args[2:]
+	}
+	// convert-routines only needs the tables to rename what the routines
+	// refer to, so defaults to all of them
+	if cfg.command == "convert-routines" && len(file.tables) == 0 {
+		cfg.all = true
+	}
+	// import reads the tables from the export's manifest
+	if file.from == "" || file.to == "" || (len(file.tables) == 0 && !cfg.all && cfg.command != "import") {
 		flag.Usage()
 		os.Exit(1)
 	}
-	cfg.from = args[0]
-	cfg.to = args[1]
-	cfg.tables = args[2:]
+	cfg.from = file.from
+	cfg.to = file.to
+	cfg.tables = file.tables
+
+	if cfg.schemaMap, err = ParseSchemaMap(*schemaMap); err != nil {
+		log.Fatal(err)
+	}
+	cfg.tableOptions = map[string]TableOptions{}
+	if file.overrides != nil {
+		if cfg.tableOptions, err = parseTableOptions(file.overrides, cfg.schema); err != nil {
+			log.Fatalf("%s: overrides: %s", cfg.configFile, err)
+		}
+	}
+	if *nameMap != "" {
+		names, err := readTableOptions(*nameMap, cfg.schema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for key, o := range names {
+			cfg.tableOptions[key] = mergeTableOptions(cfg.tableOptions[key], o)
+		}
+	}
+	if cfg.namer, err = NewNamer(*naming, cfg.tableOptions); err != nil {
+		log.Fatal(err)
+	}
 	return cfg
 }
 
 func getPrimaryKeys(table Table, db *sql.DB) []*Column {
-	rows, err := db.Query(fmt.Sprintf("sp_pkeys %s", table.OriginalName))
+	rows, err := db.Query("EXEC sp_pkeys @table_name = ?, @table_owner = ?", table.OriginalName, table.OriginalSchema)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -172,11 +552,13 @@ func getPrimaryKeys(table Table, db *sql.DB) []*Column {
 	defer rows.Close()
 	for rows.Next() {
 		pkey := MSSqlPKey{}
-		pkey.Scan(rows)
+		if err := pkey.Scan(rows); err != nil {
+			log.Fatal(err)
+		}
 
-		for _, c := range table.Columns {
+		for i, c := range table.Columns {
 			if c.OriginalName == pkey.COLUMN_NAME {
-				out = append(out, &c)
+				out = append(out, &table.Columns[i])
 				break
 			}
 		}
@@ -184,46 +566,95 @@ func getPrimaryKeys(table Table, db *sql.DB) []*Column {
 	return out
 }
 
-func getColumns(table string, db *sql.DB) []Column {
-	rows, err := db.Query(fmt.Sprintf("sp_columns %s", table))
+// Fill in the seed and increment for the table's IDENTITY column, if it has one
+func getIdentity(table Table, db *sql.DB) {
+	c := table.IdentityColumn()
+	if c == nil {
+		return
+	}
+	id := Identity{}
+	name := table.MSSqlName()
+	if err := db.QueryRow("SELECT IDENT_SEED(?), IDENT_INCR(?)", name, name).Scan(&id.Seed, &id.Increment); err != nil {
+		log.Fatal(err)
+	}
+	c.Identity = &id
+}
+
+// Read the foreign keys on a table, sp_fkeys returns one row per column so
+// they are grouped back together by FK_NAME in KEY_SEQ order.
+func getForeignKeys(table Table, db *sql.DB) []ForeignKey {
+	rows, err := db.Query("EXEC sp_fkeys @fktable_name = ?, @fktable_owner = ?", table.OriginalName, table.OriginalSchema)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	out := []Column{}
+	keys := map[string][]MSSqlFKey{}
+	order := []string{}
 	defer rows.Close()
 	for rows.Next() {
-		col := MSSqlColumn{}
-		col.Scan(rows)
-		cc := ToColumn(&col)
-		out = append(out, cc)
+		fkey := MSSqlFKey{}
+		if err := fkey.Scan(rows); err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := keys[fkey.FK_NAME]; !ok {
+			order = append(order, fkey.FK_NAME)
+		}
+		keys[fkey.FK_NAME] = append(keys[fkey.FK_NAME], fkey)
+	}
+
+	out := []ForeignKey{}
+	for _, name := range order {
+		parts := keys[name]
+		sort.Slice(parts, func(i, j int) bool { return parts[i].KEY_SEQ < parts[j].KEY_SEQ })
+		fk := ForeignKey{
+			Name:      name,
+			RefSchema: parts[0].PKTABLE_OWNER,
+			RefTable:  parts[0].PKTABLE_NAME,
+			OnUpdate:  fkRule(parts[0].UPDATE_RULE),
+			OnDelete:  fkRule(parts[0].DELETE_RULE),
+		}
+		for _, p := range parts {
+			fk.Columns = append(fk.Columns, p.FKCOLUMN_NAME)
+			fk.RefColumns = append(fk.RefColumns, p.PKCOLUMN_NAME)
+		}
+		out = append(out, fk)
 	}
 	return out
 }
 
-// Converts names from intercaps to snake case preserving
-func NameToPsql(in string) string {
-	x := []string{}
-	acc := ""
-	for i, r := range in {
-		if i != 0 && (unicode.IsUpper(r) || unicode.IsDigit(r)) {
-			x = append(x, acc)
-			acc = ""
-		}
-		acc += string(unicode.ToLower(r))
-	}
-	x = append(x, acc)
-	out := ""
-	lastSmall := false
-	for i, part := range x {
-		imSmall := len(part) == 1
-		if !(imSmall && lastSmall) {
-			if i != 0 {
-				out += "_"
-			}
+// Translate the sp_fkeys UPDATE_RULE/DELETE_RULE codes
+func fkRule(rule int) string {
+	switch rule {
+	case 0:
+		return "CASCADE"
+	case 2:
+		return "SET NULL"
+	case 3:
+		return "SET DEFAULT"
+	}
+	return "NO ACTION"
+}
+
+// Read the columns of a table. sp_columns treats the names as LIKE patterns,
+// so anything that only matched as a pattern is left out.
+func getColumns(table Table, db *sql.DB) []Column {
+	rows, err := db.Query("EXEC sp_columns @table_name = ?, @table_owner = ?", table.OriginalName, table.OriginalSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []Column{}
+	defer rows.Close()
+	for rows.Next() {
+		col := MSSqlColumn{}
+		if err := col.Scan(rows); err != nil {
+			log.Fatal(err)
+		}
+		if col.TABLE_NAME != table.OriginalName || col.TABLE_OWNER != table.OriginalSchema {
+			continue
 		}
-		lastSmall = imSmall
-		out += part
+		cc := ToColumn(&col)
+		out = append(out, cc)
 	}
 	return out
 }
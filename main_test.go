@@ -0,0 +1,12 @@
+package main
+
+import "strings"
+
+// A column as sp_columns describes it, renamed to lower case
+func testColumn(name, typ string, precision, scale int) Column {
+	return Column{
+		OriginalName: name,
+		NewName:      strings.ToLower(name),
+		col:          &MSSqlColumn{COLUMN_NAME: name, TYPE_NAME: typ, PRECISION: precision, SCALE: scale},
+	}
+}
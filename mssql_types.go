@@ -34,33 +34,51 @@ type MSSqlColumn struct {
 }
 
 func (col *MSSqlColumn) Scan(rows *sql.Rows) error {
-	return rows.Scan(
-		&col.TABLE_QUALIFIER,
+	// Several sp_columns fields are documented as possibly NULL, scan those
+	// through the sql.Null* types so a NULL doesn't abort the whole row.
+	var qualifier, remarks, def sql.NullString
+	var dataType, precision, length, scale, radix, datetimeSub, octetLength, ssDataType sql.NullInt64
+	err := rows.Scan(
+		&qualifier,
 		&col.TABLE_OWNER,
 		&col.TABLE_NAME,
 		&col.COLUMN_NAME,
-		&col.DATA_TYPE,
+		&dataType,
 		&col.TYPE_NAME,
-		&col.PRECISION,
-		&col.LENGTH,
-		&col.SCALE,
-		&col.RADIX,
+		&precision,
+		&length,
+		&scale,
+		&radix,
 		&col.NULLABLE,
-		&col.REMARKS,
-		&col.COLUMN_DEF,
+		&remarks,
+		&def,
 		&col.SQL_DATA_TYPE,
-		&col.SQL_DATETIME_SUB,
-		&col.CHAR_OCTET_LENGTH,
+		&datetimeSub,
+		&octetLength,
 		&col.ORDINAL_POSITION,
 		&col.IS_NULLABLE,
-		&col.SS_DATA_TYPE,
+		&ssDataType,
 	)
+	if err != nil {
+		return err
+	}
+	col.TABLE_QUALIFIER = qualifier.String
+	col.REMARKS = remarks.String
+	col.COLUMN_DEF = def.String
+	col.DATA_TYPE = int(dataType.Int64)
+	col.PRECISION = int(precision.Int64)
+	col.LENGTH = int(length.Int64)
+	col.SCALE = int(scale.Int64)
+	col.RADIX = int(radix.Int64)
+	col.SQL_DATETIME_SUB = int(datetimeSub.Int64)
+	col.CHAR_OCTET_LENGTH = int(octetLength.Int64)
+	col.SS_DATA_TYPE = int(ssDataType.Int64)
+	return nil
 }
 
 func ToColumn(col *MSSqlColumn) Column {
 	return Column{
 		OriginalName: col.COLUMN_NAME,
-		NewName:      NameToPsql(col.COLUMN_NAME),
 		col:          col,
 	}
 }
@@ -76,13 +94,17 @@ type MSSqlFKey struct {
 	FKCOLUMN_NAME     string // Name of the foreign key column, for each column of the TABLE_NAME returned. This field always returns a value.
 	KEY_SEQ           int    //Sequence number of the column in a multicolumn primary key. This field always returns a value.
 
-	//Action applied to the foreign key when the SQL operation is an update. SQL Server returns 0 or 1 for these columns:
+	//Action applied to the foreign key when the SQL operation is an update. SQL Server returns 0, 1, 2 or 3 for these columns:
 	//0=CASCADE changes to foreign key.
 	//1=NO ACTION changes if foreign key is present.
+	//2=SET NULL, set foreign key to NULL.
+	//3=SET DEFAULT, set foreign key to its default.
 	UPDATE_RULE int
-	//Action applied to the foreign key when the SQL operation is a deletion. SQL Server returns 0 or 1 for these columns:
+	//Action applied to the foreign key when the SQL operation is a deletion. SQL Server returns 0, 1, 2 or 3 for these columns:
 	//0=CASCADE changes to foreign key.
 	//1=NO ACTION changes if foreign key is present.
+	//2=SET NULL, set foreign key to NULL.
+	//3=SET DEFAULT, set foreign key to its default.
 	DELETE_RULE int
 
 	FK_NAME string //Foreign key identifier. It is NULL if not applicable to the data source. SQL Server returns the FOREIGN KEY constraint name.
@@ -90,21 +112,30 @@ type MSSqlFKey struct {
 }
 
 func (key *MSSqlFKey) Scan(rows *sql.Rows) error {
-	return rows.Scan(
-		&key.PKTABLE_QUALIFIER,
+	var pkQualifier, fkQualifier, fkName, pkName sql.NullString
+	err := rows.Scan(
+		&pkQualifier,
 		&key.PKTABLE_OWNER,
 		&key.PKTABLE_NAME,
 		&key.PKCOLUMN_NAME,
-		&key.FKTABLE_QUALIFIER,
+		&fkQualifier,
 		&key.FKTABLE_OWNER,
 		&key.FKTABLE_NAME,
 		&key.FKCOLUMN_NAME,
 		&key.KEY_SEQ,
 		&key.UPDATE_RULE,
 		&key.DELETE_RULE,
-		&key.FK_NAME,
-		&key.PK_NAME,
+		&fkName,
+		&pkName,
 	)
+	if err != nil {
+		return err
+	}
+	key.PKTABLE_QUALIFIER = pkQualifier.String
+	key.FKTABLE_QUALIFIER = fkQualifier.String
+	key.FK_NAME = fkName.String
+	key.PK_NAME = pkName.String
+	return nil
 }
 
 type MSSqlPKey struct {
@@ -118,12 +149,19 @@ type MSSqlPKey struct {
 }
 
 func (key *MSSqlPKey) Scan(rows *sql.Rows) error {
-	return rows.Scan(
-		&key.TABLE_QUALIFIER,
+	var qualifier, pkName sql.NullString
+	err := rows.Scan(
+		&qualifier,
 		&key.TABLE_OWNER,
 		&key.TABLE_NAME,
 		&key.COLUMN_NAME,
 		&key.KEY_SEQ,
-		&key.PK_NAME,
+		&pkName,
 	)
+	if err != nil {
+		return err
+	}
+	key.TABLE_QUALIFIER = qualifier.String
+	key.PK_NAME = pkName.String
+	return nil
 }
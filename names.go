@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// A table as named on the command line or found by discovery
+type tableName struct {
+	Schema string
+	Name   string
+}
+
+func (n tableName) String() string {
+	return n.Schema + "." + n.Name
+}
+
+// Parse "table", "schema.table" or "[schema].[table]", brackets allow names
+// with dots or spaces in them.
+func parseTableName(s, defaultSchema string) (tableName, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return tableName{}, fmt.Errorf("bad table name %q: %s", s, err)
+	}
+	parts := []string{""}
+	for _, t := range toks {
+		switch t.kind {
+		case tokDot:
+			parts = append(parts, "")
+		case tokQuoted:
+			parts[len(parts)-1] += t.name()
+		default:
+			parts[len(parts)-1] += t.text
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return tableName{Schema: defaultSchema, Name: parts[0]}, nil
+	case 2:
+		return tableName{Schema: parts[0], Name: parts[1]}, nil
+	}
+	return tableName{}, fmt.Errorf("bad table name %q, expected schema.table", s)
+}
+
+// Where each source schema ends up in Postgres. Schemas that aren't listed
+// go to a schema named by the naming strategy, except dbo which goes to
+// public.
+type SchemaMap map[string]string
+
+// Parse a list of src=dst pairs
+func ParseSchemaMap(pairs []string) (SchemaMap, error) {
+	m := SchemaMap{}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad schema mapping %q, expected src=dst", p)
+		}
+		m[strings.ToLower(kv[0])] = kv[1]
+	}
+	return m, nil
+}
+
+func (m SchemaMap) Target(schema string, naming Naming) string {
+	if dst, ok := m[strings.ToLower(schema)]; ok {
+		return dst
+	}
+	if strings.EqualFold(schema, "dbo") {
+		return "public"
+	}
+	return naming(schema)
+}
+
+// Quote an identifier for SQL Server
+func quoteMSSql(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
+
+// Quote an identifier for Postgres
+func quotePsql(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// Quote a string literal for either database
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// The quoted, schema qualified name of the original table
+func (t *Table) MSSqlName() string {
+	return quoteMSSql(t.OriginalSchema) + "." + quoteMSSql(t.OriginalName)
+}
+
+// The quoted, schema qualified name of the new table
+func (t *Table) PsqlName() string {
+	return quotePsql(t.NewSchema) + "." + quotePsql(t.NewName)
+}
+
+// The new schema and table name, for logging and keeping track of tables
+func (t *Table) Key() string {
+	return t.NewSchema + "." + t.NewName
+}
+
+func (c *Column) MSSqlName() string {
+	return quoteMSSql(c.OriginalName)
+}
+
+func (c *Column) PsqlName() string {
+	return quotePsql(c.NewName)
+}
+
+// Quote a list of new names for Postgres
+func quotePsqlNames(names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = quotePsql(n)
+	}
+	return out
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Turns a SQL Server name into a Postgres one
+type Naming func(string) string
+
+var namings = map[string]Naming{
+	"snake":    NameToPsql,
+	"lower":    strings.ToLower,
+	"preserve": preserveName,
+	"quoted":   func(s string) string { return s },
+}
+
+// Postgres silently truncates identifiers longer than this many bytes
+const psqlMaxIdentifier = 63
+
+// Converts names from intercaps to snake case. Words start at a capital
+// following a lower case letter or digit, at the last capital of an acronym
+// followed by lower case, and at a run of digits, so "HTTPRequestID" becomes
+// http_request_id and "Address2" address_2. Anything that isn't a letter or
+// digit separates words.
+func NameToPsql(in string) string {
+	rs := []rune(in)
+	words := []string{}
+	acc := []rune{}
+	split := func() {
+		if len(acc) > 0 {
+			words = append(words, string(acc))
+			acc = acc[:0]
+		}
+	}
+	for i, r := range rs {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			split()
+			continue
+		}
+		if i > 0 && len(acc) > 0 {
+			prev := rs[i-1]
+			switch {
+			case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+				split()
+			case unicode.IsUpper(r) && unicode.IsUpper(prev) && i+1 < len(rs) && unicode.IsLower(rs[i+1]) && !pluralAcronym(rs, i):
+				split()
+			case unicode.IsDigit(r) && unicode.IsLetter(prev):
+				split()
+			}
+		}
+		acc = append(acc, unicode.ToLower(r))
+	}
+	split()
+	return strings.Join(words, "_")
+}
+
+// Whether rs[i] ends an acronym with a plural s, as in "IDs"
+func pluralAcronym(rs []rune, i int) bool {
+	return rs[i+1] == 's' && (i+2 == len(rs) || !unicode.IsLower(rs[i+2]))
+}
+
+// Keeps the case of a name but replaces anything other than letters, digits
+// and underscores with an underscore.
+func preserveName(in string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '_'
+	}, in)
+}
+
+// Picks the new name of every table, column, index and constraint
+type Namer struct {
+	naming    Naming
+	overrides map[string]TableOptions // Keyed by lower case schema.table
+}
+
+// Look up a naming strategy, names given in overrides take precedence over it
+func NewNamer(strategy string, overrides map[string]TableOptions) (*Namer, error) {
+	naming, ok := namings[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown naming %q, expected snake, lower, preserve or quoted", strategy)
+	}
+	return &Namer{naming: naming, overrides: overrides}, nil
+}
+
+// Convert a name with the naming strategy
+func (n *Namer) Name(s string) string {
+	return n.naming(s)
+}
+
+// Fill in the new names of a table, its columns, indexes and constraints
+func (n *Namer) Rename(t *Table) {
+	o := n.overrides[strings.ToLower(t.OriginalSchema+"."+t.OriginalName)]
+	t.NewName = n.Name(t.OriginalName)
+	if o.Name != "" {
+		t.NewName = o.Name
+	}
+	for i := range t.Columns {
+		c := &t.Columns[i]
+		c.NewName = n.Name(c.OriginalName)
+		if newName, ok := o.Columns[strings.ToLower(c.OriginalName)]; ok {
+			c.NewName = newName
+		}
+	}
+	name := func(original string, overrides map[string]string) string {
+		if newName, ok := overrides[strings.ToLower(original)]; ok {
+			return newName
+		}
+		return n.Name(original)
+	}
+	for i := range t.ForeignKeys {
+		t.ForeignKeys[i].NewName = name(t.ForeignKeys[i].Name, o.Constraints)
+	}
+	for i := range t.Indexes {
+		t.Indexes[i].NewName = name(t.Indexes[i].Name, o.Indexes)
+	}
+	for i := range t.Checks {
+		t.Checks[i].NewName = name(t.Checks[i].Name, o.Constraints)
+	}
+}
+
+// Index names only have to be unique in their table in SQL Server, but in
+// their schema in Postgres. An index whose new name is already taken there is
+// named after its table instead, with a number added if that's taken too.
+func uniqueIndexNames(tables []Table) {
+	taken := map[string]bool{} // Keyed by schema.name
+	for _, t := range tables {
+		taken[t.NewSchema+"."+t.NewName] = true
+		if t.ComputedViewSql() != "" {
+			taken[t.NewSchema+"."+t.ComputedViewName()] = true
+		}
+	}
+	for i := range tables {
+		t := &tables[i]
+		for j := range t.Indexes {
+			ix := &t.Indexes[j]
+			name := ix.NewName
+			if taken[t.NewSchema+"."+name] {
+				name = t.NewName + "_" + ix.NewName
+				for n := 2; taken[t.NewSchema+"."+name]; n++ {
+					name = fmt.Sprintf("%s_%s_%d", t.NewName, ix.NewName, n)
+				}
+				log.Printf("Renaming  index %s.%s to %s, %s is taken in %s", t.OriginalName, ix.Name, name, ix.NewName, t.NewSchema)
+				ix.NewName = name
+			}
+			taken[t.NewSchema+"."+name] = true
+		}
+	}
+}
+
+// Find names that are empty, too long for Postgres, or that clash with
+// another name after conversion. Tables and indexes share a namespace in each
+// schema, columns and constraints have to be unique in their table.
+func checkNames(tables []Table) []string {
+	problems := []string{}
+	check := func(kind, original, name string) {
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("%s %s has an empty new name", kind, original))
+		} else if len(name) > psqlMaxIdentifier {
+			problems = append(problems, fmt.Sprintf("%s %s: new name %s is longer than %d bytes", kind, original, name, psqlMaxIdentifier))
+		}
+	}
+	clash := func(seen map[string]string, kind, original, name string) {
+		if other, ok := seen[name]; ok {
+			problems = append(problems, fmt.Sprintf("%s %s and %s both become %s", kind, other, original, name))
+			return
+		}
+		seen[name] = original
+	}
+
+	relations := map[string]map[string]string{}
+	inSchema := func(schema string) map[string]string {
+		if relations[schema] == nil {
+			relations[schema] = map[string]string{}
+		}
+		return relations[schema]
+	}
+	for _, t := range tables {
+		check("schema", t.OriginalSchema, t.NewSchema)
+		check("table", t.OriginalSchema+"."+t.OriginalName, t.NewName)
+		clash(inSchema(t.NewSchema), "relations", t.OriginalSchema+"."+t.OriginalName, t.NewName)
+		if t.ComputedViewSql() != "" {
+			clash(inSchema(t.NewSchema), "relations", "the view of "+t.OriginalSchema+"."+t.OriginalName, t.ComputedViewName())
+		}
+	}
+	for _, t := range tables {
+		columns := map[string]string{}
+		for _, c := range t.Columns {
+			check("column", t.OriginalName+"."+c.OriginalName, c.NewName)
+			clash(columns, "columns", t.OriginalName+"."+c.OriginalName, c.NewName)
+		}
+		for _, c := range t.Computed {
+			check("column", t.OriginalName+"."+c.OriginalName, c.NewName)
+			clash(columns, "columns", t.OriginalName+"."+c.OriginalName, c.NewName)
+		}
+		constraints := map[string]string{}
+		for _, fk := range t.ForeignKeys {
+			check("foreign key", fk.Name, fk.NewName)
+			clash(constraints, "constraints", fk.Name, fk.NewName)
+		}
+		for _, ck := range t.Checks {
+			check("check constraint", ck.Name, ck.NewName)
+			clash(constraints, "constraints", ck.Name, ck.NewName)
+		}
+		for _, ix := range t.Indexes {
+			check("index", ix.Name, ix.NewName)
+			clash(inSchema(t.NewSchema), "relations", ix.Name, ix.NewName)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
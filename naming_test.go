@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+// SQL Server lets every table have its own IX_CreatedDate, Postgres doesn't
+func TestSharedIndexNames(t *testing.T) {
+	namer, err := NewNamer("snake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []Table{}
+	for _, name := range []string{"Orders", "Invoices", "Shipments"} {
+		tt := Table{OriginalSchema: "dbo", OriginalName: name, NewSchema: "public",
+			Columns: []Column{testColumn("ID", "int", 10, 0), testColumn("CreatedDate", "datetime", 23, 3)}}
+		tt.PrimaryKey = []*Column{&tt.Columns[0]}
+		tt.Indexes = []Index{{Name: "IX_CreatedDate", Columns: []IndexColumn{{Name: "CreatedDate"}}}}
+		if name == "Orders" {
+			// Takes the name the index on shipments would be given
+			tt.Indexes = append(tt.Indexes, Index{Name: "Shipments_IX_CreatedDate", Columns: []IndexColumn{{Name: "ID"}}})
+		}
+		namer.Rename(&tt)
+		tables = append(tables, tt)
+	}
+	uniqueIndexNames(tables)
+
+	if problems := checkNames(tables); len(problems) > 0 {
+		t.Fatalf("name clashes: %v", problems)
+	}
+	want := [][]string{
+		{"ix_created_date", "shipments_ix_created_date"},
+		{"invoices_ix_created_date"},
+		{"shipments_ix_created_date_2"},
+	}
+	for i, tt := range tables {
+		for j, ix := range tt.Indexes {
+			if ix.NewName != want[i][j] {
+				t.Errorf("%s.%s: got %s, want %s", tt.OriginalName, ix.Name, ix.NewName, want[i][j])
+			}
+		}
+	}
+}
+
+func TestRenameIndexAndConstraintOverrides(t *testing.T) {
+	overrides, err := parseTableOptions([]byte(`{"Orders": {
+		"indexes": {"IX_CreatedDate": "orders_created_idx"},
+		"constraints": {"CK_Total": "orders_total_check", "FK_Customer": "orders_customer_fk"}}}`), "dbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namer, err := NewNamer("snake", overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := Table{OriginalSchema: "dbo", OriginalName: "Orders",
+		Indexes:     []Index{{Name: "IX_CreatedDate"}, {Name: "IX_Status"}},
+		Checks:      []CheckConstraint{{Name: "CK_Total"}},
+		ForeignKeys: []ForeignKey{{Name: "FK_Customer"}}}
+	namer.Rename(&tt)
+
+	got := []string{tt.Indexes[0].NewName, tt.Indexes[1].NewName, tt.Checks[0].NewName, tt.ForeignKeys[0].NewName}
+	want := []string{"orders_created_idx", "ix_status", "orders_total_check", "orders_customer_fk"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %s, want %s", got[i], want[i])
+		}
+	}
+}
@@ -6,89 +6,367 @@ import (
 	"strings"
 )
 
+// The statements creating every schema the tables go into
+func createSchemaSql(tables []Table) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tables {
+		if !seen[t.NewSchema] {
+			seen[t.NewSchema] = true
+			out = append(out, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quotePsql(t.NewSchema)))
+		}
+	}
+	return out
+}
+
 // Generate a DROP TABLE statment
 func (t *Table) DropSql() string {
-	return fmt.Sprintf("DROP TABLE IF EXISTS %s", t.NewName)
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE", t.PsqlName())
 }
 
 // Generate a CREATE statement for building the table
-func (t *Table) CreateSql() string {
+func (t *Table) CreateSql() (string, error) {
+	return t.createSql(true)
+}
+
+// Generate a CREATE statement for the table without its primary key, which
+// PrimaryKeySql adds once the data is loaded
+func (t *Table) CreateSqlWithoutKey() (string, error) {
+	return t.createSql(false)
+}
+
+func (t *Table) createSql(withKey bool) (string, error) {
 	cols := make([]string, len(t.Columns))
 	for i, c := range t.Columns {
-		cols[i] = c.CreateSql()
+		line, err := c.CreateSql()
+		if err != nil {
+			return "", err
+		}
+		cols[i] = line
 	}
 
-	if len(t.PrimaryKey) > 0 {
-		pk := make([]string, len(t.PrimaryKey))
-		for i, p := range t.PrimaryKey {
-			pk[i] = p.NewName
+	for _, c := range t.Computed {
+		if c.InView {
+			continue
 		}
+		line, err := c.CreateSql()
+		if err != nil {
+			return "", err
+		}
+		cols = append(cols, line)
+	}
+
+	if withKey && len(t.PrimaryKey) > 0 {
+		cols = append(cols, t.primaryKey())
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n   %s\n)", t.PsqlName(), strings.Join(cols, ",\n   ")), nil
+}
 
-		pkLine := fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(pk, ", "))
-		cols = append(cols, pkLine)
+func (t *Table) primaryKey() string {
+	pk := make([]string, len(t.PrimaryKey))
+	for i, p := range t.PrimaryKey {
+		pk[i] = p.PsqlName()
 	}
-	return fmt.Sprintf("CREATE TABLE %s (\n   %s\n)", t.NewName, strings.Join(cols, ",\n   "))
+	return fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(pk, ", "))
+}
+
+// Generate an ALTER TABLE statement adding the primary key, or an empty
+// string if the table hasn't got one
+func (t *Table) PrimaryKeySql() string {
+	if len(t.PrimaryKey) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD %s", t.PsqlName(), t.primaryKey())
 }
 
 // Generate a SELECT statement for the original MS Sql Server Table
 func (t *Table) SelectMSSql() string {
 	names := make([]string, len(t.Columns))
 	for i, c := range t.Columns {
-		names[i] = c.OriginalName
+		names[i] = c.SelectMSSql()
 	}
 	nameList := strings.Join(names, ", ")
-	return fmt.Sprintf("SELECT %s FROM %s", nameList, t.OriginalName)
+	return fmt.Sprintf("SELECT %s FROM %s", nameList, t.MSSqlFrom())
+}
+
+// Generate a SELECT statement for one chunk of the original table
+func (t *Table) SelectMSSqlChunk(c *Chunk) string {
+	return fmt.Sprintf("%s %s ORDER BY %s", t.SelectMSSql(), c.WhereMSSql(), c.Column.MSSqlName())
+}
+
+// Generate a SELECT statement for the new Postgres table
+func (t *Table) SelectPsql() string {
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(quotePsqlNames(t.newNames()), ", "), t.PsqlName())
+}
+
+// Generate a SELECT statement for one chunk of the new Postgres table
+func (t *Table) SelectPsqlChunk(c *Chunk) string {
+	return fmt.Sprintf("%s %s ORDER BY %s", t.SelectPsql(), c.WherePsql(), c.Column.PsqlName())
 }
 
 // Generate the INSERT statement for Postgres
 func (t *Table) InsertPsql() string {
-	names := make([]string, len(t.Columns))
-	place := make([]string, len(t.Columns))
+	return t.InsertPsqlRows(1)
+}
+
+// Generate an INSERT statement for Postgres with n rows in the VALUES list
+func (t *Table) InsertPsqlRows(n int) string {
+	rows := make([]string, n)
+	for r := range rows {
+		place := make([]string, len(t.Columns))
+		for i := range t.Columns {
+			place[i] = fmt.Sprintf("$%d", r*len(t.Columns)+i+1)
+		}
+		rows[r] = "(" + strings.Join(place, ", ") + ")"
+	}
+	nameList := strings.Join(quotePsqlNames(t.newNames()), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", t.PsqlName(), nameList, strings.Join(rows, ", "))
+}
+
+// Generate an INSERT statement for Postgres with n rows that updates rows
+// already there, going by the primary key
+func (t *Table) UpsertPsqlRows(n int) string {
+	pk := make([]string, len(t.PrimaryKey))
+	inPK := map[string]bool{}
+	for i, c := range t.PrimaryKey {
+		pk[i] = c.PsqlName()
+		inPK[c.OriginalName] = true
+	}
+	set := []string{}
+	for _, c := range t.Columns {
+		if !inPK[c.OriginalName] {
+			set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", c.PsqlName(), c.PsqlName()))
+		}
+	}
+	action := "DO NOTHING"
+	if len(set) > 0 {
+		action = "DO UPDATE SET " + strings.Join(set, ", ")
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) %s", t.InsertPsqlRows(n), strings.Join(pk, ", "), action)
+}
+
+// The IDENTITY column, SQL Server allows at most one per table
+func (t *Table) IdentityColumn() *Column {
 	for i, c := range t.Columns {
-		names[i] = c.NewName
-		place[i] = fmt.Sprintf("$%d", i+1)
+		if strings.HasSuffix(strings.ToLower(c.col.TYPE_NAME), " identity") {
+			return &t.Columns[i]
+		}
 	}
-	nameList := strings.Join(names, ", ")
-	placeList := strings.Join(place, ", ")
-	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.NewName, nameList, placeList)
-}
-
-// Build the name/type pair for use in a create statement
-func (c *Column) CreateSql() string {
-	return fmt.Sprintf("%s %s", c.NewName, c.PostgresType())
-}
-
-// Convert MS SQL column to a Postgres type string
-// This is by *no* means complete, its just enough to get my specific tables to
-// convert.
-//
-// Currently it converts most textual representations to TEXT because that
-// covers all the bases. Some nuance may be requied inf the future.
-//
-// Help: http://www.sqlines.com/sql-server-to-postgresql
-func (c *Column) PostgresType() string {
-	out := ""
-	switch c.col.DATA_TYPE {
-	case 4: //int
-		return "INT"
-	case -10: // ntext
-		return "TEXT"
-	case -7: // BIT
-		return "BOOL"
-	case 11: // smalldatetime
-		return "TIMESTAMP(0)"
-	case -1: // smalldatetime
-		return "TEXT"
-	case -9: // smalldatetime
-		return fmt.Sprintf("VARCHAR(%v)", c.col.PRECISION)
-	case 12: // varchar
-		return fmt.Sprintf("VARCHAR(%v)", c.col.PRECISION)
-	case 1: // char
-		return fmt.Sprintf("CHAR(%v)", c.col.PRECISION)
-	case 6: // float
-		return "FLOAT"
-	default:
-		log.Fatalf("Dont know how to translate %d (%s)", c.col.DATA_TYPE, c.col.TYPE_NAME)
+	return nil
+}
+
+// Generate the statement that moves the identity sequence past the copied
+// rows, or an empty string if the table has no identity column.
+func (t *Table) ResetIdentitySql() string {
+	c := t.IdentityColumn()
+	if c == nil || c.Identity == nil {
+		return ""
+	}
+	agg := "MAX"
+	if c.Identity.Increment < 0 {
+		agg = "MIN"
+	}
+	return fmt.Sprintf("SELECT setval(pg_get_serial_sequence(%s, %s), COALESCE(%s(%s), %d), %s(%s) IS NOT NULL) FROM %s",
+		quoteString(t.PsqlName()), quoteString(c.NewName), agg, c.PsqlName(), c.Identity.Seed, agg, c.PsqlName(), t.PsqlName())
+}
+
+// Find a column by its original name, including generated columns
+func (t *Table) Column(name string) *Column {
+	for i, c := range t.Columns {
+		if strings.EqualFold(c.OriginalName, name) {
+			return &t.Columns[i]
+		}
+	}
+	for i, c := range t.Computed {
+		if strings.EqualFold(c.OriginalName, name) && !c.InView {
+			return &t.Computed[i].Column
+		}
+	}
+	return nil
+}
+
+// Generate the ALTER TABLE statement adding a foreign key to table, the
+// referenced table has to be one of those being migrated.
+func (fk *ForeignKey) CreateSql(table *Table, tables []Table) (string, error) {
+	var ref *Table
+	for i, t := range tables {
+		if strings.EqualFold(t.OriginalSchema, fk.RefSchema) && strings.EqualFold(t.OriginalName, fk.RefTable) {
+			ref = &tables[i]
+			break
+		}
+	}
+	if ref == nil {
+		return "", fmt.Errorf("referenced table %s.%s is not being migrated", fk.RefSchema, fk.RefTable)
+	}
+
+	cols, err := newColumnNames(table, fk.Columns)
+	if err != nil {
+		return "", err
+	}
+	refCols, err := newColumnNames(ref, fk.RefColumns)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON UPDATE %s ON DELETE %s",
+		table.PsqlName(), quotePsql(fk.NewName), strings.Join(cols, ", "),
+		ref.PsqlName(), strings.Join(refCols, ", "), fk.OnUpdate, fk.OnDelete), nil
+}
+
+// Generate the statement creating an index, or adding a unique constraint
+func (ix *Index) CreateSql(table *Table) (string, error) {
+	cols := make([]string, len(ix.Columns))
+	for i, ic := range ix.Columns {
+		c := table.Column(ic.Name)
+		if c == nil {
+			return "", fmt.Errorf("no column %s on %s", ic.Name, table.OriginalName)
+		}
+		cols[i] = c.PsqlName()
+		if ic.Descending {
+			cols[i] += " DESC"
+		}
+	}
+	name := quotePsql(ix.NewName)
+
+	if ix.Constraint {
+		return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s UNIQUE (%s)",
+			table.PsqlName(), name, strings.Join(cols, ", ")), nil
+	}
+
+	out := "CREATE INDEX"
+	if ix.Unique {
+		out = "CREATE UNIQUE INDEX"
+	}
+	out += fmt.Sprintf(" %s ON %s (%s)", name, table.PsqlName(), strings.Join(cols, ", "))
+	if len(ix.Include) > 0 {
+		include, err := newColumnNames(table, ix.Include)
+		if err != nil {
+			return "", err
+		}
+		out += fmt.Sprintf(" INCLUDE (%s)", strings.Join(include, ", "))
+	}
+	if ix.Filter != "" {
+		where, err := TranslateExpr(ix.Filter, table)
+		if err != nil {
+			return "", fmt.Errorf("filter %s: %s", ix.Filter, err)
+		}
+		out += " WHERE " + where
+	}
+	return out, nil
+}
+
+// Generate the ALTER TABLE statement adding a check constraint. Constraints
+// SQL Server doesn't trust are added NOT VALID so existing rows aren't checked.
+func (ck *CheckConstraint) CreateSql(table *Table) (string, error) {
+	def, err := TranslateExpr(ck.Definition, table)
+	if err != nil {
+		return "", fmt.Errorf("check %s: %s", ck.Definition, err)
+	}
+	out := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK %s", table.PsqlName(), quotePsql(ck.NewName), def)
+	if ck.NotTrusted {
+		out += " NOT VALID"
+	}
+	return out, nil
+}
+
+// The statements creating the table's indexes, unique and check constraints.
+// Any that can't be generated are logged and left out.
+func (t *Table) IndexSql() []string {
+	out := []string{}
+	for _, ix := range t.Indexes {
+		s, err := ix.CreateSql(t)
+		if err != nil {
+			log.Printf("Skipping  index %s: %s", ix.Name, err)
+			continue
+		}
+		out = append(out, s)
+	}
+	for _, ck := range t.Checks {
+		s, err := ck.CreateSql(t)
+		if err != nil {
+			log.Printf("Skipping  check constraint %s: %s", ck.Name, err)
+			continue
+		}
+		out = append(out, s)
 	}
 	return out
 }
+
+// Map a list of original column names to their quoted new names
+func newColumnNames(table *Table, names []string) ([]string, error) {
+	out := make([]string, len(names))
+	for i, n := range names {
+		c := table.Column(n)
+		if c == nil {
+			return nil, fmt.Errorf("no column %s on %s", n, table.OriginalName)
+		}
+		out[i] = c.PsqlName()
+	}
+	return out, nil
+}
+
+// Build the column definition for use in a create statement. Defaults that
+// can't be translated are left off with a warning rather than failing.
+func (c *Column) CreateSql() (string, error) {
+	typ, err := c.PostgresType()
+	if err != nil {
+		return "", err
+	}
+	out := fmt.Sprintf("%s %s", c.PsqlName(), typ)
+
+	if c.Identity != nil {
+		// Postgres sequences count up from 1 or down from -1, a seed the other
+		// side of that needs the bound moving to take it in
+		bound := ""
+		switch {
+		case c.Identity.Increment < 0 && c.Identity.Seed > -1:
+			bound = fmt.Sprintf(" MAXVALUE %d", c.Identity.Seed)
+		case c.Identity.Increment > 0 && c.Identity.Seed < 1:
+			bound = fmt.Sprintf(" MINVALUE %d", c.Identity.Seed)
+		}
+		return out + fmt.Sprintf(" GENERATED BY DEFAULT AS IDENTITY (START WITH %d INCREMENT BY %d%s)",
+			c.Identity.Seed, c.Identity.Increment, bound), nil
+	}
+
+	if c.col.NULLABLE == 0 {
+		out += " NOT NULL"
+	}
+
+	def, err := TranslateDefault(c.col)
+	if err != nil {
+		log.Printf("Warning: %s", err)
+	} else if def != "" && c.converted() {
+		// The default was written for the old type
+		out += fmt.Sprintf(" DEFAULT (%s)::%s", def, typ)
+	} else if def != "" {
+		out += " DEFAULT " + def
+	}
+	return out, nil
+}
+
+// Convert MS SQL column to a Postgres type string, see typeMap for the list of
+// conversions.
+func (c *Column) PostgresType() (string, error) {
+	if c.Type != "" {
+		return c.Type, nil
+	}
+	for i := len(c.Transforms) - 1; i >= 0; i-- {
+		if typ := transforms[c.Transforms[i]].psql; typ != "" {
+			return typ, nil
+		}
+	}
+	m, err := lookupType(c.col)
+	if err != nil {
+		return "", err
+	}
+	return m.psql(c.col), nil
+}
+
+// The expression used to select this column from SQL Server
+func (c *Column) SelectMSSql() string {
+	m, err := lookupType(c.col)
+	if err != nil || m.selectExpr == "" {
+		return c.MSSqlName()
+	}
+	return fmt.Sprintf(m.selectExpr, c.MSSqlName())
+}
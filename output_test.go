@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestIdentityCreateSql(t *testing.T) {
+	tests := []struct {
+		seed, increment int64
+		want            string
+	}{
+		{1, 1, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1 INCREMENT BY 1)`},
+		{1000, 10, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1000 INCREMENT BY 10)`},
+		{0, 1, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH 0 INCREMENT BY 1 MINVALUE 0)`},
+		{-100, 1, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH -100 INCREMENT BY 1 MINVALUE -100)`},
+		{1, -1, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1 INCREMENT BY -1 MAXVALUE 1)`},
+		{0, -5, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH 0 INCREMENT BY -5 MAXVALUE 0)`},
+		{-1, -1, `"id" INT GENERATED BY DEFAULT AS IDENTITY (START WITH -1 INCREMENT BY -1)`},
+	}
+	for _, test := range tests {
+		c := testColumn("ID", "int identity", 10, 0)
+		c.Identity = &Identity{Seed: test.seed, Increment: test.increment}
+		got, err := c.CreateSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("IDENTITY(%d,%d): got %s, want %s", test.seed, test.increment, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A primary key range of a table, copied independently of the rest. Lo is
+// inclusive and Hi exclusive, the first and last chunks are unbounded below
+// and above respectively.
+type Chunk struct {
+	Column *Column
+	Lo, Hi int64
+	First  bool
+	Last   bool
+
+	// Called after each batch is committed with the last key written
+	OnCommit func(lastKey int64)
+}
+
+// The value of a chunk's column as the driver returns it
+func chunkKey(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case int64:
+		return x, nil
+	case int32:
+		return int64(x), nil
+	case int16:
+		return int64(x), nil
+	case int8:
+		return int64(x), nil
+	case uint8:
+		return int64(x), nil
+	case int:
+		return int64(x), nil
+	case []byte:
+		return strconv.ParseInt(string(x), 10, 64)
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected %T for the key of a chunk", v)
+}
+
+// The WHERE clause selecting the rows in the chunk from SQL Server
+func (c *Chunk) WhereMSSql() string {
+	return c.where(c.Column.MSSqlName())
+}
+
+// The WHERE clause selecting the rows in the chunk from Postgres
+func (c *Chunk) WherePsql() string {
+	return c.where(c.Column.PsqlName())
+}
+
+func (c *Chunk) where(name string) string {
+	conds := []string{}
+	if !c.First {
+		conds = append(conds, fmt.Sprintf("%s >= %d", name, c.Lo))
+	}
+	if !c.Last {
+		conds = append(conds, fmt.Sprintf("%s < %d", name, c.Hi))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+func (c *Chunk) String() string {
+	return fmt.Sprintf("%s [%d, %d)", c.Column.NewName, c.Lo, c.Hi)
+}
+
+// A unit of work for the copy workers, a whole table or one chunk of it
+type copyJob struct {
+	table Table
+	chunk *Chunk
+
+	// Clear out anything a previous run left in the target first
+	clear bool
+
+	// Marks the job as finished in the checkpoint state
+	finish func()
+}
+
+func (j copyJob) String() string {
+	if j.chunk == nil {
+		return j.table.Key()
+	}
+	return fmt.Sprintf("%s %s", j.table.Key(), j.chunk)
+}
+
+var integerTypes = map[string]bool{"bigint": true, "int": true, "smallint": true, "tinyint": true}
+
+// The column a table can be split on, its primary key if that is a single
+// integer column.
+func (t *Table) ChunkColumn() *Column {
+	if len(t.PrimaryKey) != 1 || !integerTypes[t.PrimaryKey[0].col.BaseTypeName()] {
+		return nil
+	}
+	return t.Column(t.PrimaryKey[0].OriginalName)
+}
+
+// Break the tables up into jobs. Tables with more than chunkRows rows are
+// split into primary key ranges of roughly chunkRows each, assuming the keys
+// are spread evenly. Tables with an integer key always get at least one chunk
+// so their progress can be checkpointed.
+//
+// When resuming, finished work is skipped, chunks are taken from the state
+// instead of being planned again and pick up after their last committed key.
+func planJobs(db *sql.DB, tables []Table, chunkRows int64, state *State, resume bool) []copyJob {
+	jobs := []copyJob{}
+	for _, t := range tables {
+		t := t
+		ts := state.Table(t.Key())
+		if ts.Done {
+			log.Println("Skipping  ", t.Key(), "already copied")
+			continue
+		}
+
+		col := t.ChunkColumn()
+		if col == nil {
+			jobs = append(jobs, copyJob{
+				table:  t,
+				clear:  resume,
+				finish: func() { ts.Done = true },
+			})
+			continue
+		}
+
+		if len(ts.Chunks) == 0 {
+			chunks := planChunks(db, t, col, chunkRows)
+			if err := state.Update(func() { ts.Chunks = chunks }); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		for _, cs := range ts.Chunks {
+			if cs.Done {
+				continue
+			}
+			cs := cs
+			c := &Chunk{Column: col, Lo: cs.Lo, Hi: cs.Hi, First: cs.First, Last: cs.Last}
+			if cs.LastKey != nil {
+				c.Lo = *cs.LastKey + 1
+				c.First = false
+			}
+			c.OnCommit = func(lastKey int64) {
+				if err := state.Update(func() { cs.LastKey = &lastKey }); err != nil {
+					log.Fatal(err)
+				}
+			}
+			jobs = append(jobs, copyJob{
+				table: t,
+				chunk: c,
+				clear: resume,
+				finish: func() {
+					cs.Done = true
+					for _, other := range ts.Chunks {
+						if !other.Done {
+							return
+						}
+					}
+					ts.Done = true
+				},
+			})
+		}
+	}
+	return jobs
+}
+
+// Split a table into ranges of col with about chunkRows rows each
+func planChunks(db *sql.DB, t Table, col *Column, chunkRows int64) []*ChunkState {
+	var lo, hi sql.NullInt64
+	var count int64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s), COUNT_BIG(*) FROM %s", col.MSSqlName(), col.MSSqlName(), t.MSSqlFrom())
+	if err := db.QueryRow(query).Scan(&lo, &hi, &count); err != nil {
+		log.Fatal(err)
+	}
+	if chunkRows <= 0 || count <= chunkRows {
+		return []*ChunkState{{Lo: lo.Int64, Hi: hi.Int64 + 1, First: true, Last: true}}
+	}
+
+	n := (count + chunkRows - 1) / chunkRows
+	step := (hi.Int64 - lo.Int64 + n) / n
+	chunks := []*ChunkState{}
+	for i := int64(0); i < n; i++ {
+		chunks = append(chunks, &ChunkState{
+			Lo:    lo.Int64 + i*step,
+			Hi:    lo.Int64 + (i+1)*step,
+			First: i == 0,
+			Last:  i == n-1,
+		})
+	}
+	log.Printf("Splitting  %s into %d chunks", t.Key(), n)
+	return chunks
+}
+
+// Run the jobs over a pool of workers, each with its own connections to both
+// databases. Stops handing out work after the first failure and returns it.
+func runJobs(cfg config, jobs []copyJob, state *State) error {
+	workers := cfg.jobs
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	queue := make(chan copyJob)
+	errs := make(chan error, workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			logger := log.New(os.Stderr, fmt.Sprintf("[worker %d] ", w), log.LstdFlags)
+			from := ConnectAndTest("mssql", cfg.from)
+			defer from.Close()
+			to := ConnectAndTest("postgres", cfg.to)
+			defer to.Close()
+
+			for job := range queue {
+				if err := runJob(from, to, job, cfg.copy, state, logger); err != nil {
+					errs <- fmt.Errorf("%s: %s", job, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+feed:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(queue)
+	<-done
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+func runJob(from, to *sql.DB, job copyJob, opts CopyOptions, state *State, logger *log.Logger) error {
+	if job.clear {
+		var clearSql string
+		if job.chunk == nil {
+			clearSql = fmt.Sprintf("TRUNCATE %s", job.table.PsqlName())
+		} else {
+			clearSql = fmt.Sprintf("DELETE FROM %s %s", job.table.PsqlName(), job.chunk.WherePsql())
+		}
+		if _, err := to.Exec(clearSql); err != nil {
+			return err
+		}
+	}
+
+	logger.Println("Copying   ", job)
+	if err := CopyChunk(from, to, job.table, job.chunk, opts, logger); err != nil {
+		return err
+	}
+	return state.Update(job.finish)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Collects the rows that couldn't be copied when running with --max-errors.
+// Written as JSON lines, or CSV if the file name ends in .csv, with one record
+// per row holding the table, the source primary key, every column value and
+// the error from Postgres.
+type RejectLog struct {
+	MaxErrors int
+
+	mu    sync.Mutex
+	count int
+	file  io.WriteCloser
+	csv   *csv.Writer
+	json  *json.Encoder
+}
+
+type rejectedRow struct {
+	Table  string                 `json:"table"`
+	Key    map[string]interface{} `json:"key"`
+	Values map[string]interface{} `json:"values"`
+	Error  string                 `json:"error"`
+}
+
+func OpenRejectLog(path string, maxErrors int) (*RejectLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &RejectLog{MaxErrors: maxErrors, file: f}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		r.csv = csv.NewWriter(f)
+		r.csv.Write([]string{"table", "key", "values", "error"})
+	} else {
+		r.json = json.NewEncoder(f)
+	}
+	return r, nil
+}
+
+// Record a rejected row, failing once more than MaxErrors rows have been
+// rejected.
+func (r *RejectLog) Reject(table Table, row []interface{}, rowErr error) error {
+	rec := rejectedRow{
+		Table:  table.Key(),
+		Key:    map[string]interface{}{},
+		Values: map[string]interface{}{},
+		Error:  rowErr.Error(),
+	}
+	for i, c := range table.Columns {
+		rec.Values[c.OriginalName] = jsonValue(row[i])
+	}
+	for _, p := range table.PrimaryKey {
+		rec.Key[p.OriginalName] = rec.Values[p.OriginalName]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.csv != nil {
+		key, _ := json.Marshal(rec.Key)
+		values, _ := json.Marshal(rec.Values)
+		r.csv.Write([]string{rec.Table, string(key), string(values), rec.Error})
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			return err
+		}
+	} else if err := r.json.Encode(rec); err != nil {
+		return err
+	}
+
+	r.count++
+	if r.count > r.MaxErrors {
+		return fmt.Errorf("more than %d rows rejected, last: %s", r.MaxErrors, rowErr)
+	}
+	return nil
+}
+
+func (r *RejectLog) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+func (r *RejectLog) Close() error {
+	return r.file.Close()
+}
+
+// Text columns come back from the driver as []byte, keep them readable
+func jsonValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok && utf8.Valid(b) {
+		return string(b)
+	}
+	return v
+}
+
+// Insert the rows of a failed batch one at a time, each under a savepoint, so
+// the good rows are kept and the bad ones go to the reject log. The values are
+// sent the way the writers send them, so the same rows fail. Returns the index
+// of the first row that was rejected, or -1 if none were.
+func replayBatch(db *sql.DB, table Table, batch [][]interface{}, rejects *RejectLog) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+
+	insert := table.InsertPsql()
+	bytea := table.byteaColumns()
+	first := -1
+	for i, row := range batch {
+		if _, err := tx.Exec("SAVEPOINT replay_row"); err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+		if _, rowErr := tx.Exec(insert, textValues(row, bytea)...); rowErr != nil {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT replay_row"); err != nil {
+				tx.Rollback()
+				return -1, err
+			}
+			if err := rejects.Reject(table, row, rowErr); err != nil {
+				tx.Rollback()
+				return -1, err
+			}
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT replay_row"); err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	return first, nil
+}
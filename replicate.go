@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The __$operation codes in a CDC change table
+const (
+	cdcDelete       = 1
+	cdcInsert       = 2
+	cdcUpdateBefore = 3
+	cdcUpdateAfter  = 4
+)
+
+// One row change, Row holds the values of the table's columns in order
+type change struct {
+	Table *Table
+	LSN   []byte
+	Seq   []byte
+	Op    int
+	Row   []interface{}
+}
+
+// Where changes come from, the CDC functions of a live server or a recorded
+// change set.
+type changeSource interface {
+	// The LSN to replicate up to in this pass
+	MaxLSN() ([]byte, error)
+	// The changes to a table after one LSN up to and including another,
+	// after is nil if nothing has been applied yet.
+	TableChanges(t *Table, after, upTo []byte) ([]change, error)
+}
+
+// Anything statements can be run on, a *sql.Tx when applying for real
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Put changes to several tables into the order they were made. An update's
+// before and after images share their sequence number, the before comes first.
+func sortChanges(changes []change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if c := bytes.Compare(changes[i].LSN, changes[j].LSN); c != 0 {
+			return c < 0
+		}
+		if c := bytes.Compare(changes[i].Seq, changes[j].Seq); c != 0 {
+			return c < 0
+		}
+		return changes[i].Op < changes[j].Op
+	})
+}
+
+// Apply changes in order. Inserts and updates are upserts and deletes don't
+// mind the row being gone, so changes already applied by the initial copy or
+// an interrupted pass can safely be applied again. An update that changes the
+// primary key deletes the row under the key from its before image.
+func applyChanges(db execer, changes []change) error {
+	// The key from the before image of an update, which sorts just ahead of
+	// its after image
+	var beforeTable *Table
+	var beforeKey []interface{}
+	for _, c := range changes {
+		t := c.Table
+		row := append([]interface{}(nil), c.Row...)
+		if err := t.transformRow(row); err != nil {
+			return fmt.Errorf("%s: %s", t.Key(), err)
+		}
+		if c.Op == cdcUpdateBefore {
+			beforeTable, beforeKey = t, t.keyValues(row)
+			continue
+		}
+
+		var err error
+		switch c.Op {
+		case cdcInsert, cdcUpdateAfter:
+			if c.Op == cdcUpdateAfter && beforeTable == t && !reflect.DeepEqual(beforeKey, t.keyValues(row)) {
+				_, err = db.Exec(t.DeletePsqlKey(), beforeKey...)
+			}
+			if err == nil {
+				_, err = db.Exec(t.UpsertPsqlRows(1), textValues(row, t.byteaColumns())...)
+			}
+		case cdcDelete:
+			_, err = db.Exec(t.DeletePsqlKey(), t.keyValues(row)...)
+		default:
+			err = fmt.Errorf("unknown operation %d", c.Op)
+		}
+		beforeTable, beforeKey = nil, nil
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.Key(), err)
+		}
+	}
+	return nil
+}
+
+// Generate a DELETE statement for the row with a given primary key
+func (t *Table) DeletePsqlKey() string {
+	conds := make([]string, len(t.PrimaryKey))
+	for i, c := range t.PrimaryKey {
+		conds[i] = fmt.Sprintf("%s = $%d", c.PsqlName(), i+1)
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", t.PsqlName(), strings.Join(conds, " AND "))
+}
+
+// The primary key values from a row
+func (t *Table) keyValues(row []interface{}) []interface{} {
+	vals := textValues(row, t.byteaColumns())
+	out := []interface{}{}
+	for _, pk := range t.PrimaryKey {
+		for i, c := range t.Columns {
+			if c.OriginalName == pk.OriginalName {
+				out = append(out, vals[i])
+			}
+		}
+	}
+	return out
+}
+
+// Gather every table's changes up to the source's current LSN and apply them
+// in one transaction, then checkpoint the LSN.
+func replicatePass(src changeSource, psqlDB *sql.DB, tables []*Table, state *State) (int, error) {
+	upTo, err := src.MaxLSN()
+	if err != nil || upTo == nil {
+		return 0, err
+	}
+
+	all := []change{}
+	marks := []*TableState{}
+	for _, t := range tables {
+		ts := state.Table(t.Key())
+		marks = append(marks, ts)
+		var after []byte
+		if ts.AppliedLSN != "" {
+			if after, err = hex.DecodeString(strings.TrimPrefix(ts.AppliedLSN, "0x")); err != nil {
+				return 0, fmt.Errorf("%s: bad applied LSN: %s", t.Key(), err)
+			}
+			if bytes.Compare(after, upTo) >= 0 {
+				continue
+			}
+		}
+		changes, err := src.TableChanges(t, after, upTo)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", t.Key(), err)
+		}
+		all = append(all, changes...)
+	}
+	sortChanges(all)
+
+	tx, err := psqlDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if err := applyChanges(tx, all); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	lsn := "0x" + hex.EncodeToString(upTo)
+	return len(all), state.Update(func() {
+		for _, ts := range marks {
+			ts.AppliedLSN = lsn
+		}
+	})
+}
+
+// Reads changes with the cdc.fn_cdc_get_all_changes_* functions
+type cdcSource struct {
+	db        *sql.DB
+	instances map[string]string
+}
+
+func newCDCSource(db *sql.DB) *cdcSource {
+	return &cdcSource{db: db, instances: map[string]string{}}
+}
+
+func cdcEnabled(db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT is_cdc_enabled FROM sys.databases WHERE name = DB_NAME()").Scan(&enabled)
+	return enabled, err
+}
+
+// The table's newest capture instance, or "" if CDC isn't enabled for it
+func (s *cdcSource) captureInstance(t *Table) (string, error) {
+	if name, ok := s.instances[t.Key()]; ok {
+		return name, nil
+	}
+	var name string
+	err := s.db.QueryRow(`SELECT TOP 1 capture_instance FROM cdc.change_tables
+		WHERE source_object_id = OBJECT_ID(?) ORDER BY create_date DESC`, t.MSSqlName()).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	s.instances[t.Key()] = name
+	return name, nil
+}
+
+func (s *cdcSource) MaxLSN() ([]byte, error) {
+	var lsn []byte
+	err := s.db.QueryRow("SELECT sys.fn_cdc_get_max_lsn()").Scan(&lsn)
+	return lsn, err
+}
+
+func (s *cdcSource) TableChanges(t *Table, after, upTo []byte) ([]change, error) {
+	instance, err := s.captureInstance(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes before the capture instance's minimum LSN have been cleaned up
+	var min []byte
+	if err := s.db.QueryRow("SELECT sys.fn_cdc_get_min_lsn(?)", instance).Scan(&min); err != nil {
+		return nil, err
+	}
+	from := min
+	if after != nil {
+		if err := s.db.QueryRow("SELECT sys.fn_cdc_increment_lsn(?)", after).Scan(&from); err != nil {
+			return nil, err
+		}
+		if bytes.Compare(from, min) < 0 {
+			return nil, fmt.Errorf("changes since the last applied LSN have been cleaned up by CDC, migrate the table again")
+		}
+	}
+	if bytes.Compare(from, upTo) > 0 {
+		return nil, nil
+	}
+
+	names := make([]string, len(t.Columns))
+	for i := range t.Columns {
+		names[i] = t.Columns[i].SelectMSSql()
+	}
+	// The $ in the CDC column names has to be bracketed, or the driver takes
+	// it for a parameter
+	query := fmt.Sprintf(`SELECT [__$start_lsn], [__$seqval], [__$operation], %s
+		FROM cdc.%s(?, ?, N'all update old') ORDER BY [__$start_lsn], [__$seqval], [__$operation]`,
+		strings.Join(names, ", "), quoteMSSql("fn_cdc_get_all_changes_"+instance))
+	rows, err := s.db.Query(query, from, upTo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []change{}
+	for rows.Next() {
+		c := change{Table: t, Row: make([]interface{}, len(t.Columns))}
+		dest := []interface{}{&c.LSN, &c.Seq, &c.Op}
+		for i := range c.Row {
+			dest = append(dest, &c.Row[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// A change set recorded as JSON lines, one change per line:
+//
+//	{"table": "dbo.Orders", "lsn": "0x0000002a000001f00003", "seq": "0x0000002a000001f00002",
+//	 "op": 2, "row": {"OrderID": 7, "Status": "shipped"}}
+//
+// Columns missing from "row" are NULL.
+type recordedChanges struct {
+	changes []recordedChange
+}
+
+type recordedChange struct {
+	Table string                 `json:"table"`
+	LSN   string                 `json:"lsn"`
+	Seq   string                 `json:"seq"`
+	Op    int                    `json:"op"`
+	Row   map[string]interface{} `json:"row"`
+
+	lsn, seq []byte
+}
+
+func loadRecordedChanges(path, defaultSchema string) (*recordedChanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := &recordedChanges{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(scanner.Text()))
+		dec.UseNumber()
+		var rc recordedChange
+		if err := dec.Decode(&rc); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		name, err := parseTableName(rc.Table, defaultSchema)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		rc.Table = strings.ToLower(name.String())
+		if rc.lsn, err = hex.DecodeString(strings.TrimPrefix(rc.LSN, "0x")); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad lsn: %s", path, n, err)
+		}
+		if rc.seq, err = hex.DecodeString(strings.TrimPrefix(rc.Seq, "0x")); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad seq: %s", path, n, err)
+		}
+		out.changes = append(out.changes, rc)
+	}
+	return out, scanner.Err()
+}
+
+func (r *recordedChanges) MaxLSN() ([]byte, error) {
+	var max []byte
+	for _, rc := range r.changes {
+		if bytes.Compare(rc.lsn, max) > 0 {
+			max = rc.lsn
+		}
+	}
+	return max, nil
+}
+
+func (r *recordedChanges) TableChanges(t *Table, after, upTo []byte) ([]change, error) {
+	key := strings.ToLower(t.OriginalSchema + "." + t.OriginalName)
+	out := []change{}
+	for _, rc := range r.changes {
+		if rc.Table != key || bytes.Compare(rc.lsn, after) <= 0 || bytes.Compare(rc.lsn, upTo) > 0 {
+			continue
+		}
+		row := make([]interface{}, len(t.Columns))
+		for name, v := range rc.Row {
+			found := false
+			for i, c := range t.Columns {
+				if strings.EqualFold(c.OriginalName, name) {
+					row[i] = v
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no column %s", name)
+			}
+		}
+		out = append(out, change{Table: t, LSN: rc.lsn, Seq: rc.seq, Op: rc.Op, Row: row})
+	}
+	return out, nil
+}
+
+// Record the LSN replication should start after, before a table's rows are
+// first copied. Changes made while the copy runs are applied again by the
+// first replicate pass, which is harmless.
+func recordReplicationStart(db *sql.DB, tables []Table, state *State) error {
+	if enabled, err := cdcEnabled(db); err != nil || !enabled {
+		return err
+	}
+	src := newCDCSource(db)
+	for i := range tables {
+		t := &tables[i]
+		ts := state.Table(t.Key())
+		if ts.Done || ts.AppliedLSN != "" {
+			continue
+		}
+		instance, err := src.captureInstance(t)
+		if err != nil {
+			return err
+		}
+		if instance == "" {
+			continue
+		}
+		lsn, err := src.MaxLSN()
+		if err != nil {
+			return err
+		}
+		if err := state.Update(func() { ts.AppliedLSN = "0x" + hex.EncodeToString(lsn) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply CDC changes to Postgres every interval until stopped, or a recorded
+// change set once.
+func runReplicate(cfg config, msDB *sql.DB, tables []Table) {
+	state := NewState(cfg.stateFile)
+	if loaded, err := LoadState(cfg.stateFile); err == nil {
+		state = loaded
+	}
+	psqlDB := ConnectAndTest("postgres", cfg.to)
+
+	var src changeSource
+	if cfg.changes != "" {
+		recorded, err := loadRecordedChanges(cfg.changes, cfg.schema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = recorded
+	} else {
+		if enabled, err := cdcEnabled(msDB); err != nil {
+			log.Fatal(err)
+		} else if !enabled {
+			log.Fatal("CDC isn't enabled on the source database")
+		}
+		src = newCDCSource(msDB)
+	}
+
+	replicated := []*Table{}
+	for i := range tables {
+		t := &tables[i]
+		if cdc, ok := src.(*cdcSource); ok {
+			instance, err := cdc.captureInstance(t)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if instance == "" {
+				log.Printf("Skipping  %s: CDC isn't enabled for it", t.Key())
+				continue
+			}
+		}
+		switch {
+		case len(t.PrimaryKey) == 0:
+			log.Printf("Skipping  %s: no primary key to apply changes by", t.Key())
+		case t.Filtered():
+			log.Printf("Skipping  %s: changes can't be filtered", t.Key())
+		default:
+			replicated = append(replicated, t)
+		}
+	}
+
+	interval := cfg.interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		count, err := replicatePass(src, psqlDB, replicated, state)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if count > 0 {
+			log.Printf("Applied %d changes", count)
+		}
+		if cfg.changes != "" {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Stands in for the Postgres transaction, keeping what's run on it
+type recordingExecer struct {
+	stmts []string
+}
+
+func (e *recordingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.stmts = append(e.stmts, fmt.Sprintf("%s %v", query, args))
+	return driver.RowsAffected(1), nil
+}
+
+func TestApplyRecordedChanges(t *testing.T) {
+	// Out of LSN order, as two tables' change tables would be read
+	recorded := `
+{"table": "dbo.Orders", "lsn": "0x0000002a000001f00001", "seq": "0x01", "op": 2, "row": {"OrderID": 1, "Status": "new"}}
+{"table": "dbo.Orders", "lsn": "0x0000002a000001f00003", "seq": "0x02", "op": 4, "row": {"OrderID": 1, "Status": "shipped"}}
+{"table": "dbo.Orders", "lsn": "0x0000002a000001f00003", "seq": "0x01", "op": 3, "row": {"OrderID": 1, "Status": "new"}}
+{"table": "Customers", "lsn": "0x0000002a000001f00004", "seq": "0x01", "op": 1, "row": {"CustomerID": 10, "Name": "Ann"}}
+{"table": "dbo.Orders", "lsn": "0x0000002a000001f00005", "seq": "0x01", "op": 4, "row": {"OrderID": 2, "Status": "shipped"}}
+{"table": "dbo.Orders", "lsn": "0x0000002a000001f00005", "seq": "0x01", "op": 3, "row": {"OrderID": 1, "Status": "shipped"}}
+{"table": "Customers", "lsn": "0x0000002a000001f00002", "seq": "0x01", "op": 2, "row": {"CustomerID": 10, "Name": "Ann"}}
+`
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	if err := ioutil.WriteFile(path, []byte(recorded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := loadRecordedChanges(path, "dbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders := &Table{OriginalSchema: "dbo", OriginalName: "Orders", NewSchema: "public", NewName: "orders",
+		Columns: []Column{testColumn("OrderID", "int", 10, 0), testColumn("Status", "nvarchar", 20, 0)}}
+	orders.PrimaryKey = []*Column{&orders.Columns[0]}
+	customers := &Table{OriginalSchema: "dbo", OriginalName: "Customers", NewSchema: "public", NewName: "customers",
+		Columns: []Column{testColumn("CustomerID", "int", 10, 0), testColumn("Name", "nvarchar", 50, 0)}}
+	customers.PrimaryKey = []*Column{&customers.Columns[0]}
+	upTo, err := src.MaxLSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := []change{}
+	for _, table := range []*Table{orders, customers} {
+		changes, err := src.TableChanges(table, nil, upTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, changes...)
+	}
+	sortChanges(all)
+
+	db := &recordingExecer{}
+	if err := applyChanges(db, all); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`INSERT INTO "public"."orders" ("orderid", "status") VALUES ($1, $2) ON CONFLICT ("orderid") DO UPDATE SET "status" = EXCLUDED."status" [1 new]`,
+		`INSERT INTO "public"."customers" ("customerid", "name") VALUES ($1, $2) ON CONFLICT ("customerid") DO UPDATE SET "name" = EXCLUDED."name" [10 Ann]`,
+		`INSERT INTO "public"."orders" ("orderid", "status") VALUES ($1, $2) ON CONFLICT ("orderid") DO UPDATE SET "status" = EXCLUDED."status" [1 shipped]`,
+		`DELETE FROM "public"."customers" WHERE "customerid" = $1 [10]`,
+		`DELETE FROM "public"."orders" WHERE "orderid" = $1 [1]`,
+		`INSERT INTO "public"."orders" ("orderid", "status") VALUES ($1, $2) ON CONFLICT ("orderid") DO UPDATE SET "status" = EXCLUDED."status" [2 shipped]`,
+	}
+	if !reflect.DeepEqual(db.stmts, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(db.stmts, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRecordedChangesAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	recorded := `{"table": "dbo.Orders", "lsn": "0x01", "seq": "0x01", "op": 2, "row": {"OrderID": 1}}
+{"table": "dbo.Orders", "lsn": "0x02", "seq": "0x01", "op": 2, "row": {"OrderID": 2}}
+{"table": "dbo.Orders", "lsn": "0x03", "seq": "0x01", "op": 2, "row": {"OrderID": 3}}
+`
+	if err := ioutil.WriteFile(path, []byte(recorded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := loadRecordedChanges(path, "dbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the changes after the applied LSN, up to and including upTo
+	orders := &Table{OriginalSchema: "dbo", OriginalName: "Orders", NewSchema: "public", NewName: "orders",
+		Columns: []Column{testColumn("OrderID", "int", 10, 0)}}
+	changes, err := src.TableChanges(orders, []byte{1}, []byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || fmt.Sprint(changes[0].Row[0]) != "2" {
+		t.Errorf("got %v, want just OrderID 2", changes)
+	}
+}
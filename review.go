@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Something that couldn't be translated automatically, written to the
+// --report file for someone to finish by hand
+type reviewItem struct {
+	Kind       string // view, function, trigger...
+	Source     string // Name in SQL Server
+	Target     string // Name in Postgres
+	Issues     []string
+	Original   string // The T-SQL
+	Translated string // As far as the translation got
+}
+
+// Write the items that need reviewing, with the original definition and
+// the attempted translation next to each other
+func writeReview(path string, items []reviewItem) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, item := range items {
+		fmt.Fprintf(w, "== %s %s -> %s\n\n", item.Kind, item.Source, item.Target)
+		for _, issue := range item.Issues {
+			fmt.Fprintf(w, "  - %s\n", issue)
+		}
+		fmt.Fprintf(w, "\n-- Original\n%s\n\n", strings.TrimSpace(item.Original))
+		if item.Translated != "" {
+			fmt.Fprintf(w, "-- Translation\n%s\n\n", strings.TrimSpace(item.Translated))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
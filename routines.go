@@ -0,0 +1,892 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// A stored procedure or function and its PL/pgSQL skeleton
+type Routine struct {
+	Table             // Only the names are used
+	Type       string // sys.objects type: P, FN, IF, TF, or TR for a trigger's function
+	Definition string
+	Sql        string
+	Issues     []string // What was left as TODO
+	result     []string // Result columns of table valued functions, as name type
+}
+
+func (r *Routine) kind() string {
+	switch r.Type {
+	case "P":
+		return "procedure"
+	case "TR":
+		return "trigger"
+	}
+	return "function"
+}
+
+// Statements that start a new statement when routines leave out semicolons
+var statementStarts = map[string]bool{
+	"begin": true, "break": true, "commit": true, "continue": true, "deallocate": true,
+	"declare": true, "delete": true, "else": true, "end": true, "exec": true,
+	"execute": true, "fetch": true, "goto": true, "if": true, "insert": true,
+	"merge": true, "print": true, "raiserror": true, "return": true, "rollback": true,
+	"save": true, "select": true, "set": true, "throw": true, "truncate": true,
+	"update": true, "while": true, "with": true,
+}
+
+// Read the procedures and functions in a schema, filtered like the tables
+func getRoutines(db *sql.DB, schema string, include, exclude []string) []Routine {
+	rows, err := db.Query(`SELECT s.name, o.name, RTRIM(o.type), m.definition
+		FROM sys.objects o
+		JOIN sys.schemas s ON s.schema_id = o.schema_id
+		LEFT JOIN sys.sql_modules m ON m.object_id = o.object_id
+		WHERE o.type IN ('P', 'FN', 'IF', 'TF') AND o.is_ms_shipped = 0 AND s.name = ?
+		ORDER BY o.name`, schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []Routine{}
+	defer rows.Close()
+	for rows.Next() {
+		r := Routine{}
+		var def sql.NullString
+		if err := rows.Scan(&r.OriginalSchema, &r.OriginalName, &r.Type, &def); err != nil {
+			log.Fatal(err)
+		}
+		name := tableName{Schema: r.OriginalSchema, Name: r.OriginalName}
+		if len(filterTables([]tableName{name}, include, exclude)) == 0 {
+			continue
+		}
+		r.Definition = def.String
+		if !def.Valid {
+			r.Issues = append(r.Issues, "the definition is encrypted")
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// The columns a table valued function returns, named and typed for Postgres
+func getResultColumns(db *sql.DB, r *Routine, namer *Namer) error {
+	rows, err := db.Query(`SELECT c.name, t.name, c.max_length, c.precision, c.scale
+		FROM sys.columns c
+		JOIN sys.types t ON t.user_type_id = c.user_type_id
+		WHERE c.object_id = OBJECT_ID(?)
+		ORDER BY c.column_id`, r.MSSqlName())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ string
+		var length, precision, scale int
+		if err := rows.Scan(&name, &typ, &length, &precision, &scale); err != nil {
+			return err
+		}
+		pg, _, err := psqlCastType(typeWithSize(typ, length, precision, scale))
+		if err != nil {
+			r.Issues = append(r.Issues, fmt.Sprintf("result column %s: %s", name, err))
+		}
+		r.result = append(r.result, quotePsql(namer.Name(name))+" "+pg)
+	}
+	return rows.Err()
+}
+
+// Put a sys.types name back together with its size, eg nvarchar(50)
+func typeWithSize(typ string, length, precision, scale int) string {
+	switch typ {
+	case "nchar", "nvarchar":
+		if length > 0 {
+			length /= 2
+		}
+		fallthrough
+	case "char", "varchar", "binary", "varbinary":
+		if length < 0 {
+			return typ + "(max)"
+		}
+		return fmt.Sprintf("%s(%d)", typ, length)
+	case "decimal", "numeric":
+		return fmt.Sprintf("%s(%d,%d)", typ, precision, scale)
+	case "time", "datetime2", "datetimeoffset":
+		return fmt.Sprintf("%s(%d)", typ, scale)
+	}
+	return typ
+}
+
+// Converts one routine, keeping track of its variables and what it couldn't
+// convert
+type routineConverter struct {
+	r        *Routine
+	tr       *translator
+	toks     []token
+	declare  []string // Lines of the DECLARE section
+	retTable string   // The variable a multi-statement table valued function returns
+}
+
+// Convert a routine into a PL/pgSQL function. Parameters and variables get
+// p_ and v_ prefixes so they can't be mistaken for columns.
+func (r *Routine) convert(relations map[string]*Table, namer *Namer) {
+	tr, err := newQueryTranslator(r.Definition, r.OriginalSchema, relations, namer)
+	if err != nil {
+		r.Issues = append(r.Issues, err.Error())
+		return
+	}
+	// Problems are noted against each statement as it's translated instead
+	tr.issues = nil
+	tr.vars = map[string]variable{}
+	rc := &routineConverter{r: r, tr: tr, toks: tr.toks}
+
+	// CREATE PROCEDURE|FUNCTION name [(] params [)] [RETURNS type] [WITH options] AS body
+	toks := tr.toks
+	i := 0
+	for i < len(toks) && !toks[i].is("proc", "procedure", "function") {
+		i++
+	}
+	if i = nextToken(toks, i); i < 0 {
+		r.Issues = append(r.Issues, "can't find the routine's name")
+		return
+	}
+	_, i = dottedName(toks, i)
+
+	params, i := rc.params(nextToken(toks, i))
+	returns := "void"
+	if r.Type == "P" {
+		for _, p := range params {
+			if strings.HasPrefix(p, "INOUT ") {
+				returns = ""
+			}
+		}
+	} else {
+		returns, i = rc.returns(i)
+	}
+	for i >= 0 && !toks[i].is("as") {
+		i = nextToken(toks, i)
+	}
+	if i < 0 {
+		r.Issues = append(r.Issues, "can't find the routine's body")
+		return
+	}
+	hi := len(toks)
+	for hi > i && (toks[hi-1].kind == tokSpace || toks[hi-1].text == ";") {
+		hi--
+	}
+
+	var body []string
+	if r.Type == "IF" {
+		body = rc.returnQuery(nextToken(toks, i), hi)
+	} else {
+		body, _ = rc.statements(nextToken(toks, i), hi, false)
+	}
+
+	r.Sql = rc.function(params, returns, body)
+}
+
+// The CREATE FUNCTION for the routine, with the variables declared
+func (rc *routineConverter) function(params []string, returns string, body []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE OR REPLACE FUNCTION %s(%s)\n", rc.r.PsqlName(), strings.Join(params, ", "))
+	if returns != "" {
+		fmt.Fprintf(&b, "RETURNS %s\n", returns)
+	}
+	b.WriteString("LANGUAGE plpgsql\nAS $$\n")
+	if len(rc.declare) > 0 {
+		b.WriteString("DECLARE\n")
+		for _, line := range rc.declare {
+			b.WriteString("   " + line + "\n")
+		}
+	}
+	b.WriteString("BEGIN\n")
+	for _, line := range indent(body) {
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("END;\n$$")
+	return b.String()
+}
+
+// Parse the parameter list starting at token i, returning each as a
+// Postgres parameter and the index of the token after the list
+func (rc *routineConverter) params(i int) ([]string, int) {
+	toks := rc.toks
+	if i < 0 {
+		return nil, i
+	}
+	lo, hi := i, len(toks)
+	parens := toks[i].kind == tokLParen
+	if parens {
+		lo, hi = i+1, matchParen(toks, i)
+	} else {
+		// Procedures can leave out the brackets, the list ends at AS or WITH
+		// where they aren't part of a parameter
+		for j := i; j >= 0; j = nextToken(toks, j) {
+			if toks[j].is("with", "for") || (toks[j].is("as") && !strings.HasPrefix(toks[prevToken(toks, j)].text, "@")) {
+				hi = j
+				break
+			}
+		}
+	}
+
+	out := []string{}
+	for _, r := range rc.tr.args(lo-1, hi) {
+		p, ok := rc.param(r[0], r[1])
+		if ok {
+			out = append(out, p)
+		}
+	}
+	if parens {
+		return out, nextToken(toks, hi)
+	}
+	return out, hi
+}
+
+// @name [AS] type [= default] [OUT|OUTPUT] [READONLY]
+func (rc *routineConverter) param(lo, hi int) (string, bool) {
+	toks := rc.toks
+	i := nextToken(toks, lo-1)
+	if i < 0 || i >= hi || !strings.HasPrefix(toks[i].text, "@") {
+		return "", false
+	}
+	name := toks[i].text
+	typeLo := nextToken(toks, i)
+	if typeLo >= 0 && toks[typeLo].is("as") {
+		typeLo = nextToken(toks, typeLo)
+	}
+	typeHi, def, mode := hi, "", ""
+	for j := typeLo; j >= 0 && j < hi; j = nextToken(toks, j) {
+		switch {
+		case toks[j].kind == tokOp && toks[j].text == "=":
+			if typeHi == hi {
+				typeHi = j
+			}
+			end := j + 1
+			for end < hi && !toks[end].is("out", "output", "readonly") {
+				end++
+			}
+			d, issues := rc.translate(j+1, end)
+			def = " DEFAULT " + d
+			rc.note(issues)
+		case toks[j].is("out", "output"):
+			if typeHi == hi {
+				typeHi = j
+			}
+			mode = "INOUT "
+		case toks[j].is("readonly", "varying"):
+			if typeHi == hi {
+				typeHi = j
+			}
+			if toks[j].is("readonly") {
+				rc.note([]string{fmt.Sprintf("table valued parameter %s", name)})
+			}
+		}
+	}
+	typ, kind, err := psqlCastType(strings.TrimSpace(joinTokens(toks[typeLo:typeHi])))
+	if err != nil {
+		rc.note([]string{fmt.Sprintf("parameter %s: %s", name, err)})
+	}
+	pg := rc.variable(name, "p_", kind)
+	return fmt.Sprintf("%s%s %s%s", mode, pg, typ, def), true
+}
+
+// Add a parameter or variable, returning its Postgres name
+func (rc *routineConverter) variable(name, prefix string, kind valueKind) string {
+	pg := quotePsql(prefix + rc.tr.namer.Name(strings.TrimPrefix(name, "@")))
+	rc.tr.vars[strings.ToLower(name)] = variable{name: pg, kind: kind}
+	return pg
+}
+
+// RETURNS type, RETURNS TABLE or RETURNS @name TABLE (...), returning the
+// Postgres return type and the index of the token after it
+func (rc *routineConverter) returns(i int) (string, int) {
+	toks := rc.toks
+	if i < 0 || !toks[i].is("returns") {
+		rc.note([]string{"can't find the return type"})
+		return "void", i
+	}
+	i = nextToken(toks, i)
+	if i >= 0 && strings.HasPrefix(toks[i].text, "@") {
+		rc.retTable = strings.ToLower(toks[i].text)
+		i = nextToken(toks, i)
+	}
+	if i >= 0 && toks[i].is("table") {
+		if j := nextToken(toks, i); j >= 0 && toks[j].kind == tokLParen {
+			i = matchParen(toks, j)
+		}
+		if len(rc.r.result) == 0 {
+			rc.note([]string{"list the columns the function returns"})
+			return "SETOF record", nextToken(toks, i)
+		}
+		return fmt.Sprintf("TABLE (%s)", strings.Join(rc.r.result, ", ")), nextToken(toks, i)
+	}
+
+	end := i
+	for end >= 0 && !toks[end].is("as", "with") {
+		end = nextToken(toks, end)
+	}
+	if end < 0 {
+		end = len(toks)
+	}
+	typ, _, err := psqlCastType(strings.TrimSpace(joinTokens(toks[i:end])))
+	if err != nil {
+		rc.note([]string{fmt.Sprintf("return type: %s", err)})
+	}
+	return typ, end
+}
+
+// Record reasons for the review, once each
+func (rc *routineConverter) note(issues []string) {
+	for _, issue := range issues {
+		if !containsFold(rc.r.Issues, issue) {
+			rc.r.Issues = append(rc.r.Issues, issue)
+		}
+	}
+}
+
+// Translate tokens, returning what couldn't be translated separately
+func (rc *routineConverter) translate(lo, hi int) (string, []string) {
+	rc.tr.issues = nil
+	out := strings.TrimSpace(rc.tr.translate(lo, hi))
+	issues := rc.tr.issues
+	rc.tr.issues = nil
+	return out, issues
+}
+
+// A TODO comment in place of a statement, with the original T-SQL
+func (rc *routineConverter) todo(lo, hi int, issues []string) []string {
+	rc.note(issues)
+	lines := []string{}
+	for _, issue := range issues {
+		lines = append(lines, "-- TODO: "+issue)
+	}
+	original := strings.TrimSpace(joinTokens(rc.toks[lo:hi]))
+	lines = append(lines, "/*")
+	lines = append(lines, strings.Split(strings.Replace(original, "*/", "* /", -1), "\n")...)
+	return append(lines, "*/")
+}
+
+// A statement that translates as a whole or becomes a TODO
+func (rc *routineConverter) whole(lo, hi int) []string {
+	out, issues := rc.translate(lo, hi)
+	if len(issues) > 0 {
+		return rc.todo(lo, hi, issues)
+	}
+	return []string{out + ";"}
+}
+
+func indent(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = "   " + line
+	}
+	return out
+}
+
+// Skip whitespace and semicolons
+func (rc *routineConverter) skip(i, hi int) int {
+	for i >= 0 && i < hi && (rc.toks[i].kind == tokSpace || rc.toks[i].text == ";") {
+		i++
+	}
+	return i
+}
+
+// Convert statements from i up to hi, or in a block up to its END. Returns
+// the lines and the index of the END or hi.
+func (rc *routineConverter) statements(i, hi int, block bool) ([]string, int) {
+	lines := []string{}
+	for i = rc.skip(i, hi); i >= 0 && i < hi; i = rc.skip(i, hi) {
+		if block && rc.toks[i].is("end") {
+			return lines, i
+		}
+		var stmt []string
+		stmt, i = rc.statement(i, hi)
+		lines = append(lines, stmt...)
+	}
+	return lines, hi
+}
+
+// Convert the statement at i, returning its lines and the index after it
+func (rc *routineConverter) statement(i, hi int) ([]string, int) {
+	if i < 0 || i >= hi {
+		return nil, hi
+	}
+	toks := rc.toks
+	t := toks[i]
+	switch {
+	case t.is("begin"):
+		next := nextToken(toks, i)
+		if next >= 0 && toks[next].is("try") {
+			return rc.tryCatch(i, hi)
+		}
+		if next >= 0 && toks[next].is("tran", "transaction", "distributed") {
+			break
+		}
+		body, end := rc.statements(next, hi, true)
+		if end >= hi {
+			return rc.todo(i, hi, []string{"BEGIN without END"}), hi
+		}
+		return body, end + 1
+
+	case t.is("if"):
+		condEnd := rc.end(i, hi)
+		then, end := rc.statement(rc.skip(condEnd, hi), hi)
+		var els []string
+		if e := rc.skip(end, hi); e >= 0 && e < hi && toks[e].is("else") {
+			els, end = rc.statement(rc.skip(e+1, hi), hi)
+		}
+		cond, issues := rc.translate(i+1, condEnd)
+		if len(issues) > 0 {
+			return rc.todo(i, end, issues), end
+		}
+		lines := []string{"IF " + cond + " THEN"}
+		lines = append(lines, indent(then)...)
+		if els != nil {
+			lines = append(lines, "ELSE")
+			lines = append(lines, indent(els)...)
+		}
+		return append(lines, "END IF;"), end
+
+	case t.is("while"):
+		condEnd := rc.end(i, hi)
+		body, end := rc.statement(rc.skip(condEnd, hi), hi)
+		cond, issues := rc.translate(i+1, condEnd)
+		if len(issues) > 0 {
+			return rc.todo(i, end, issues), end
+		}
+		lines := []string{"WHILE " + cond + " LOOP"}
+		lines = append(lines, indent(body)...)
+		return append(lines, "END LOOP;"), end
+	}
+
+	end := rc.end(i, hi)
+	return rc.simple(i, end), end
+}
+
+// BEGIN TRY ... END TRY BEGIN CATCH ... END CATCH as a block with an
+// exception handler
+func (rc *routineConverter) tryCatch(i, hi int) ([]string, int) {
+	toks := rc.toks
+	try, end := rc.statements(nextToken(toks, i)+1, hi, true)
+	catchAt := -1
+	if j := nextToken(toks, end); j >= 0 && toks[j].is("try") {
+		if k := nextToken(toks, j); k >= 0 && toks[k].is("begin") {
+			if l := nextToken(toks, k); l >= 0 && toks[l].is("catch") {
+				catchAt = l
+			}
+		}
+	}
+	if catchAt < 0 {
+		return rc.todo(i, hi, []string{"BEGIN TRY without BEGIN CATCH"}), hi
+	}
+	catch, end := rc.statements(catchAt+1, hi, true)
+	if j := nextToken(toks, end); j >= 0 && toks[j].is("catch") {
+		end = j
+	}
+	lines := []string{"BEGIN"}
+	lines = append(lines, indent(try)...)
+	lines = append(lines, "EXCEPTION WHEN OTHERS THEN")
+	lines = append(lines, indent(catch)...)
+	return append(lines, "END;"), end + 1
+}
+
+// The index after a simple statement, or after an IF or WHILE condition,
+// found by looking for the next statement keyword outside brackets
+func (rc *routineConverter) end(i, hi int) int {
+	toks := rc.toks
+	first := strings.ToLower(toks[i].text)
+	depth, cases := 0, 0
+	seenSelect, seenSet, seenMain := false, false, false
+	for j := i + 1; j < hi; j++ {
+		t := toks[j]
+		switch t.kind {
+		case tokLParen:
+			depth++
+			continue
+		case tokRParen:
+			if depth--; depth < 0 {
+				return j
+			}
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		if t.text == ";" {
+			return j
+		}
+		if t.is("case") {
+			cases++
+		}
+		if t.is("end") && cases > 0 {
+			cases--
+			continue
+		}
+		if t.kind != tokIdent || !statementStarts[strings.ToLower(t.text)] || cases > 0 {
+			continue
+		}
+
+		prev := prevToken(toks, j)
+		next := nextToken(toks, j)
+		switch {
+		case t.is("update") && next >= 0 && toks[next].kind == tokLParen:
+			// UPDATE(column) in a trigger
+			continue
+		case first == "if" || first == "while":
+		case prev >= 0 && toks[prev].is("then", "union", "all", "except", "intersect", "rows", "row", "for"):
+			continue
+		case t.is("with") && next >= 0 && (toks[next].kind == tokLParen || toks[next].is("ties")):
+			continue
+		case t.is("select") && first == "insert" && !seenSelect:
+			seenSelect = true
+			continue
+		case t.is("set") && first == "update" && !seenSet:
+			seenSet = true
+			continue
+		case first == "with" && !seenMain && t.is("select", "insert", "update", "delete", "merge"):
+			seenMain = true
+			continue
+		}
+		return j
+	}
+	return hi
+}
+
+// Convert a statement that doesn't contain others
+func (rc *routineConverter) simple(lo, hi int) []string {
+	toks := rc.toks
+	t := toks[lo]
+	next := nextToken(toks, lo)
+	switch {
+	case t.is("declare"):
+		return rc.declareStmt(lo, hi)
+	case t.is("set"):
+		return rc.setStmt(lo, hi)
+	case t.is("select"):
+		return rc.selectStmt(lo, hi)
+	case t.is("return"):
+		return rc.returnStmt(lo, hi)
+	case t.is("insert", "update", "delete", "truncate", "with"):
+		return rc.dml(lo, hi)
+	case t.is("print"):
+		expr, issues := rc.translate(next, hi)
+		if len(issues) > 0 {
+			return rc.todo(lo, hi, issues)
+		}
+		return []string{fmt.Sprintf("RAISE NOTICE '%%', %s;", expr)}
+	case t.is("break"):
+		return []string{"EXIT;"}
+	case t.is("continue"):
+		return []string{"CONTINUE;"}
+	case t.is("exec", "execute"):
+		return rc.todo(lo, hi, []string{"calls another procedure"})
+	case t.is("begin", "commit", "rollback", "save"):
+		return rc.todo(lo, hi, []string{"transaction control isn't allowed in a function"})
+	case t.is("raiserror", "throw"):
+		return rc.todo(lo, hi, []string{"raise the error with RAISE EXCEPTION"})
+	}
+	return rc.todo(lo, hi, []string{fmt.Sprintf("%s statement", strings.ToUpper(t.text))})
+}
+
+// DECLARE @a type [= value], ... adds to the DECLARE section and assigns
+// the initial values where the DECLARE was
+func (rc *routineConverter) declareStmt(lo, hi int) []string {
+	toks := rc.toks
+	lines := []string{}
+	for _, r := range rc.tr.args(lo, hi) {
+		i := nextToken(toks, r[0]-1)
+		if i < 0 || i >= r[1] || !strings.HasPrefix(toks[i].text, "@") {
+			return rc.todo(lo, hi, []string{"DECLARE of a cursor"})
+		}
+		name := toks[i].text
+		typeLo := nextToken(toks, i)
+		if typeLo >= 0 && toks[typeLo].is("as") {
+			typeLo = nextToken(toks, typeLo)
+		}
+		if typeLo >= 0 && toks[typeLo].is("table", "cursor") {
+			return rc.todo(lo, hi, []string{fmt.Sprintf("%s variable %s, use a temporary table or a query", strings.ToUpper(toks[typeLo].text), name)})
+		}
+		typeHi := r[1]
+		for j := typeLo; j >= 0 && j < r[1]; j++ {
+			if toks[j].kind == tokOp && toks[j].text == "=" {
+				typeHi = j
+				break
+			}
+		}
+		typ, kind, err := psqlCastType(strings.TrimSpace(joinTokens(toks[typeLo:typeHi])))
+		if err != nil {
+			return rc.todo(lo, hi, []string{fmt.Sprintf("%s: %s", name, err)})
+		}
+		pg := rc.variable(name, "v_", kind)
+		rc.declare = append(rc.declare, fmt.Sprintf("%s %s;", pg, typ))
+		if typeHi < r[1] {
+			value, issues := rc.translate(typeHi+1, r[1])
+			if len(issues) > 0 {
+				lines = append(lines, rc.todo(lo, hi, issues)...)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s := %s;", pg, value))
+		}
+	}
+	return lines
+}
+
+// SET @a = value, or SET @a += value. Session options like SET NOCOUNT ON
+// mean nothing to Postgres and are dropped.
+func (rc *routineConverter) setStmt(lo, hi int) []string {
+	toks := rc.toks
+	i := nextToken(toks, lo)
+	if i < 0 || i >= hi || !strings.HasPrefix(toks[i].text, "@") {
+		return nil
+	}
+	v, ok := rc.tr.vars[strings.ToLower(toks[i].text)]
+	op := nextToken(toks, i)
+	if !ok || op < 0 || toks[op].kind != tokOp || !strings.HasSuffix(toks[op].text, "=") {
+		return rc.todo(lo, hi, []string{fmt.Sprintf("SET of %s", toks[i].text)})
+	}
+	if value := strings.TrimSpace(joinTokens(toks[op+1 : hi])); strings.EqualFold(value, "@@ROWCOUNT") && toks[op].text == "=" {
+		return []string{fmt.Sprintf("GET DIAGNOSTICS %s = ROW_COUNT;", v.name)}
+	}
+	value, issues := rc.translate(op+1, hi)
+	if len(issues) > 0 {
+		return rc.todo(lo, hi, issues)
+	}
+	if compound := strings.TrimSuffix(toks[op].text, "="); compound != "" {
+		if compound == "+" && v.kind == kindText {
+			compound = "||"
+		}
+		value = fmt.Sprintf("%s %s (%s)", v.name, compound, value)
+	}
+	return []string{fmt.Sprintf("%s := %s;", v.name, value)}
+}
+
+// SELECT @a = x, @b = y FROM ... becomes SELECT x, y INTO v_a, v_b FROM ...
+// A SELECT returning rows is left for whoever decides what the function
+// returns.
+func (rc *routineConverter) selectStmt(lo, hi int) []string {
+	toks := rc.toks
+	listEnd := hi
+	depth := 0
+	for j := lo + 1; j < hi; j++ {
+		switch toks[j].kind {
+		case tokLParen:
+			depth++
+		case tokRParen:
+			depth--
+		}
+		if depth == 0 && toks[j].is("from", "where", "group", "having", "order", "union", "except", "intersect", "option") {
+			listEnd = j
+			break
+		}
+	}
+
+	vars, exprs := []string{}, []string{}
+	for _, r := range rc.tr.args(lo, listEnd) {
+		i := nextToken(toks, r[0]-1)
+		op := nextToken(toks, i)
+		v, ok := rc.tr.vars[strings.ToLower(toks[i].text)]
+		if !ok || op < 0 || op >= r[1] || toks[op].text != "=" {
+			break
+		}
+		expr, issues := rc.translate(op+1, r[1])
+		if len(issues) > 0 {
+			return rc.todo(lo, hi, issues)
+		}
+		vars, exprs = append(vars, v.name), append(exprs, expr)
+	}
+	if len(vars) == 0 {
+		query, issues := rc.translate(lo, hi)
+		lines := rc.todo(lo, hi, append([]string{"returns a result set, return it with RETURN QUERY"}, issues...))
+		return append(lines, "-- "+strings.Replace(query, "\n", "\n-- ", -1))
+	}
+	if len(vars) != len(rc.tr.args(lo, listEnd)) {
+		return rc.todo(lo, hi, []string{"SELECT both assigns variables and returns rows"})
+	}
+
+	rest, issues := rc.translate(listEnd, hi)
+	if len(issues) > 0 {
+		return rc.todo(lo, hi, issues)
+	}
+	stmt := fmt.Sprintf("SELECT %s INTO %s", strings.Join(exprs, ", "), strings.Join(vars, ", "))
+	if rest != "" {
+		stmt += " " + rest
+	}
+	return []string{stmt + ";"}
+}
+
+func (rc *routineConverter) returnStmt(lo, hi int) []string {
+	if rc.r.Type == "TR" {
+		// A trigger's result is ignored after the event, or skips the row before it
+		return []string{"RETURN NULL;"}
+	}
+	i := nextToken(rc.toks, lo)
+	if i < 0 || i >= hi {
+		return []string{"RETURN;"}
+	}
+	switch rc.r.Type {
+	case "FN":
+		value, issues := rc.translate(i, hi)
+		if len(issues) > 0 {
+			return rc.todo(lo, hi, issues)
+		}
+		return []string{fmt.Sprintf("RETURN %s;", value)}
+	case "IF":
+		return rc.returnQuery(i, hi)
+	}
+	return append(rc.todo(lo, hi, []string{"procedures can't return a status, return it in an OUT parameter"}), "RETURN;")
+}
+
+// The query an inline table valued function returns, with or without
+// brackets around it
+func (rc *routineConverter) returnQuery(i, hi int) []string {
+	toks := rc.toks
+	if i >= 0 && toks[i].is("return") {
+		i = nextToken(toks, i)
+	}
+	if i < 0 || i >= hi {
+		return rc.todo(0, hi, []string{"can't find the query the function returns"})
+	}
+	lo, end := i, hi
+	if toks[i].kind == tokLParen {
+		if close := matchParen(toks, i); close >= 0 {
+			lo, end = i+1, close
+		}
+	}
+	query, issues := rc.translate(lo, end)
+	if len(issues) > 0 {
+		return rc.todo(i, hi, issues)
+	}
+	return []string{"RETURN QUERY " + query + ";", "RETURN;"}
+}
+
+// INSERT, UPDATE, DELETE and TRUNCATE are the same in Postgres apart from
+// their names and functions, except for the parts that aren't
+func (rc *routineConverter) dml(lo, hi int) []string {
+	toks := rc.toks
+	depth, froms := 0, 0
+	for j := lo; j < hi; j++ {
+		switch toks[j].kind {
+		case tokLParen:
+			depth++
+		case tokRParen:
+			depth--
+		}
+		if depth > 0 {
+			continue
+		}
+		switch {
+		case toks[j].is("output"):
+			return rc.todo(lo, hi, []string{"OUTPUT clause, use RETURNING"})
+		case toks[j].is("exec", "execute"):
+			return rc.todo(lo, hi, []string{"INSERT ... EXEC"})
+		case toks[j].is("from"):
+			froms++
+		}
+	}
+
+	t := toks[lo]
+	next := nextToken(toks, lo)
+	switch {
+	case t.is("update") && froms > 0:
+		return rc.todo(lo, hi, []string{"UPDATE ... FROM joins differently in Postgres"})
+	case t.is("delete") && (next < 0 || !toks[next].is("from") || froms > 1):
+		return rc.todo(lo, hi, []string{"DELETE ... FROM joins differently in Postgres"})
+	case t.is("insert"):
+		target := next
+		if target >= 0 && toks[target].is("into") {
+			target = nextToken(toks, target)
+		}
+		if target >= 0 && strings.HasPrefix(toks[target].text, "@") {
+			after := nextToken(toks, target)
+			if strings.ToLower(toks[target].text) == rc.retTable && after >= 0 && toks[after].is("select") {
+				query, issues := rc.translate(after, hi)
+				if len(issues) > 0 {
+					return rc.todo(lo, hi, issues)
+				}
+				return []string{"RETURN QUERY " + query + ";"}
+			}
+			return rc.todo(lo, hi, []string{fmt.Sprintf("INSERT into table variable %s", toks[target].text)})
+		}
+	}
+	return rc.whole(lo, hi)
+}
+
+// Read and convert the procedures and functions in the tables' schemas
+func loadRoutines(cfg config, msDB *sql.DB, tables []Table, views []View) []Routine {
+	schemas := []string{cfg.schema}
+	for _, t := range tables {
+		if !containsFold(schemas, t.OriginalSchema) {
+			schemas = append(schemas, t.OriginalSchema)
+		}
+	}
+	routines := []Routine{}
+	for _, schema := range schemas {
+		routines = append(routines, getRoutines(msDB, schema, cfg.include, cfg.exclude)...)
+	}
+
+	relations := map[string]*Table{}
+	for i := range tables {
+		relations[strings.ToLower(tables[i].OriginalSchema+"."+tables[i].OriginalName)] = &tables[i]
+	}
+	for i := range views {
+		relations[strings.ToLower(views[i].OriginalSchema+"."+views[i].OriginalName)] = &views[i].Table
+	}
+	for i := range routines {
+		r := &routines[i]
+		r.NewSchema = cfg.schemaMap.Target(r.OriginalSchema, cfg.namer.Name)
+		cfg.namer.Rename(&r.Table)
+		if r.Definition == "" {
+			continue
+		}
+		if r.Type == "IF" || r.Type == "TF" {
+			if err := getResultColumns(msDB, r, cfg.namer); err != nil {
+				log.Fatal(err)
+			}
+		}
+		r.convert(relations, cfg.namer)
+	}
+	return routines
+}
+
+func routineReview(routines []Routine) []reviewItem {
+	items := []reviewItem{}
+	for _, r := range routines {
+		if len(r.Issues) == 0 {
+			continue
+		}
+		items = append(items, reviewItem{
+			Kind:       r.kind(),
+			Source:     r.OriginalSchema + "." + r.OriginalName,
+			Target:     r.Key(),
+			Issues:     r.Issues,
+			Original:   r.Definition,
+			Translated: r.Sql,
+		})
+	}
+	return items
+}
+
+// Write the PL/pgSQL for every routine to a file for porting by hand
+func runConvertRoutines(cfg config, msDB *sql.DB, tables []Table, views []View) {
+	routines := loadRoutines(cfg, msDB, tables, views)
+	var b strings.Builder
+	for _, r := range routines {
+		if r.Sql == "" {
+			fmt.Fprintf(&b, "-- Skipped %s %s: %s\n\n", r.kind(), r.Key(), strings.Join(r.Issues, ", "))
+			continue
+		}
+		if len(r.Issues) > 0 {
+			fmt.Fprintf(&b, "-- The %s %s needs finishing by hand, see the TODOs\n", r.kind(), r.Key())
+		}
+		fmt.Fprintf(&b, "%s;\n\n", r.Sql)
+	}
+	if err := ioutil.WriteFile(cfg.to, []byte(b.String()), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d procedures and functions to %s", len(routines), cfg.to)
+	reportReview(cfg, routineReview(routines))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint of a migration's progress, saved as JSON after every change so a
+// failed run can be picked up again with --resume.
+type State struct {
+	path string
+	mu   sync.Mutex
+
+	Tables map[string]*TableState `json:"tables"`
+}
+
+// Keyed by the new table name
+type TableState struct {
+	Created     bool          `json:"created"`
+	Done        bool          `json:"done"`
+	Chunks      []*ChunkState `json:"chunks,omitempty"`
+	Indexes     bool          `json:"indexes"`
+	ForeignKeys bool          `json:"foreign_keys"`
+	SyncMark    string        `json:"sync_mark,omitempty"`   // How far sync has got
+	AppliedLSN  string        `json:"applied_lsn,omitempty"` // How far replicate has got
+}
+
+// A chunk as planned by planJobs, kept so a resumed run copies exactly the same
+// ranges. LastKey is the last primary key committed to Postgres.
+type ChunkState struct {
+	Lo      int64  `json:"lo"`
+	Hi      int64  `json:"hi"`
+	First   bool   `json:"first"`
+	Last    bool   `json:"last"`
+	Done    bool   `json:"done"`
+	LastKey *int64 `json:"last_key,omitempty"`
+}
+
+func NewState(path string) *State {
+	return &State{path: path, Tables: map[string]*TableState{}}
+}
+
+func LoadState(path string) (*State, error) {
+	s := NewState(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Tables == nil {
+		s.Tables = map[string]*TableState{}
+	}
+	return s, nil
+}
+
+// The state for a table, added if it isn't there yet
+func (s *State) Table(name string) *TableState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.Tables[name]
+	if !ok {
+		ts = &TableState{}
+		s.Tables[name] = ts
+	}
+	return ts
+}
+
+// Apply a change and write the state out. Safe to call from several workers.
+func (s *State) Update(change func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change()
+	return s.save()
+}
+
+// Write to a temporary file and rename it over the old one, so a crash never
+// leaves a half written state behind.
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".state")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
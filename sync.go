@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The column sync finds changed rows by, the one named with "sync_column" or
+// else the table's rowversion column. Nil if there isn't one.
+func (t *Table) SyncColumn() *Column {
+	if t.Sync != "" {
+		return t.Column(t.Sync)
+	}
+	for i, c := range t.Columns {
+		if isRowversion(&c) {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+func isRowversion(c *Column) bool {
+	name := c.col.BaseTypeName()
+	return name == "timestamp" || name == "rowversion"
+}
+
+// The high-water mark to sync up to. For a rowversion this is the lowest
+// version still in use by an open transaction, so rows below it can't change
+// under us. For other columns it's the highest value in the table.
+func currentMark(db *sql.DB, t Table, c *Column) (interface{}, error) {
+	query := fmt.Sprintf("SELECT MAX(%s) FROM %s", c.MSSqlName(), t.MSSqlFrom())
+	if isRowversion(c) {
+		query = "SELECT MIN_ACTIVE_ROWVERSION()"
+	}
+	var mark interface{}
+	err := db.QueryRow(query).Scan(&mark)
+	return mark, err
+}
+
+// Marks are kept in the state file as text
+func encodeMark(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case []byte:
+		return "0x" + hex.EncodeToString(x), nil
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	}
+	return "", fmt.Errorf("can't sync on %T values", v)
+}
+
+func decodeMark(c *Column, s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	switch c.kind() {
+	case kindBinary:
+		return hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	case kindTime:
+		return time.Parse(time.RFC3339Nano, s)
+	case kindInteger:
+		return strconv.ParseInt(s, 10, 64)
+	}
+	return nil, fmt.Errorf("can't sync on %s columns", c.col.TYPE_NAME)
+}
+
+// Generate a SELECT statement for the rows changed between two marks. A
+// rowversion mark is the first version not yet copied, other marks are the
+// last value that was.
+func (t *Table) SelectMSSqlChanged(c *Column, from bool) string {
+	conds := []string{}
+	if isRowversion(c) {
+		if from {
+			conds = append(conds, fmt.Sprintf("%s >= ?", c.MSSqlName()))
+		}
+		conds = append(conds, fmt.Sprintf("%s < ?", c.MSSqlName()))
+	} else {
+		if from {
+			conds = append(conds, fmt.Sprintf("%s > ?", c.MSSqlName()))
+		}
+		conds = append(conds, fmt.Sprintf("%s <= ?", c.MSSqlName()))
+	}
+	return fmt.Sprintf("%s WHERE %s ORDER BY %s", t.SelectMSSql(), strings.Join(conds, " AND "), c.MSSqlName())
+}
+
+// Record where sync should start from before a table's rows are first
+// copied. Rows changed while the copy runs are picked up again by the first
+// sync, which is harmless as sync upserts.
+func recordSyncStart(db *sql.DB, t Table, state *State) error {
+	c := t.SyncColumn()
+	ts := state.Table(t.Key())
+	if c == nil || ts.Done || ts.SyncMark != "" {
+		return nil
+	}
+	mark, err := currentMark(db, t, c)
+	if err != nil {
+		return err
+	}
+	s, err := encodeMark(mark)
+	if err != nil {
+		return err
+	}
+	return state.Update(func() { ts.SyncMark = s })
+}
+
+// Upsert the rows changed since the table's mark in one transaction, then
+// move the mark on. A table that was never marked is copied in full.
+//
+// A transaction still open when the mark was taken can commit rows dated at
+// or before it, so dates are read again from overlap before the mark. The
+// rows in the overlap are upserted a second time, which does no harm.
+func syncTable(from, to *sql.DB, t Table, state *State, batchSize int, overlap time.Duration) (int, error) {
+	c := t.SyncColumn()
+	ts := state.Table(t.Key())
+	hi, err := currentMark(from, t, c)
+	if err != nil {
+		return 0, err
+	}
+	if hi == nil {
+		return 0, nil
+	}
+	lo, err := decodeMark(c, ts.SyncMark)
+	if err != nil {
+		return 0, err
+	}
+	if at, ok := lo.(time.Time); ok {
+		lo = at.Add(-overlap)
+	}
+
+	args := []interface{}{hi}
+	if lo != nil {
+		args = []interface{}{lo, hi}
+	}
+	rows, err := from.Query(t.SelectMSSqlChanged(c, lo != nil), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := to.Begin()
+	if err != nil {
+		return 0, err
+	}
+	perStmt := batchSize
+	if max := psqlMaxParams / len(t.Columns); perStmt > max || perStmt < 1 {
+		perStmt = max
+	}
+	bytea := t.byteaColumns()
+	pending := []interface{}{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		_, err := tx.Exec(t.UpsertPsqlRows(len(pending)/len(t.Columns)), pending...)
+		pending = pending[:0]
+		return err
+	}
+
+	count := 0
+	rr := make([]interface{}, len(t.Columns))
+	ra := make([]interface{}, len(t.Columns))
+	for i := range ra {
+		ra[i] = &rr[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ra...); err != nil {
+			tx.Rollback()
+			return count, err
+		}
+		if err := t.transformRow(rr); err != nil {
+			tx.Rollback()
+			return count, err
+		}
+		pending = append(pending, textValues(rr, bytea)...)
+		count++
+		if count%perStmt == 0 {
+			if err := flush(); err != nil {
+				tx.Rollback()
+				return count, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return count, err
+	}
+	if err := flush(); err != nil {
+		tx.Rollback()
+		return count, err
+	}
+	if err := tx.Commit(); err != nil {
+		return count, err
+	}
+
+	mark, err := encodeMark(hi)
+	if err != nil {
+		return count, err
+	}
+	return count, state.Update(func() { ts.SyncMark = mark })
+}
+
+// Sync every table that can be, once or every interval until stopped
+func runSync(cfg config, msDB *sql.DB, tables []Table) {
+	state := NewState(cfg.stateFile)
+	if loaded, err := LoadState(cfg.stateFile); err == nil {
+		state = loaded
+	}
+	psqlDB := ConnectAndTest("postgres", cfg.to)
+
+	synced := []Table{}
+	for _, t := range tables {
+		switch {
+		case t.SyncColumn() == nil:
+			log.Printf("Skipping  %s: no rowversion or sync_column", t.Key())
+		case len(t.PrimaryKey) == 0:
+			log.Printf("Skipping  %s: no primary key to upsert on", t.Key())
+		default:
+			synced = append(synced, t)
+		}
+	}
+
+	for {
+		for _, t := range synced {
+			count, err := syncTable(msDB, psqlDB, t, state, cfg.copy.BatchSize, cfg.syncOverlap)
+			if err != nil {
+				log.Fatalf("%s: %s", t.Key(), err)
+			}
+			if count > 0 {
+				log.Printf("Synced %d rows into %s", count, t.Key())
+			}
+		}
+		if cfg.interval <= 0 {
+			return
+		}
+		time.Sleep(cfg.interval)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A named change made to a column's values on their way into Postgres
+type transform struct {
+	fn   func(v interface{}) (interface{}, error)
+	psql string // Type the column becomes unless it's given one explicitly
+}
+
+var transforms = map[string]transform{
+	"trim":       {fn: mapText(strings.TrimSpace)},
+	"rtrim":      {fn: mapText(func(s string) string { return strings.TrimRight(s, " ") })},
+	"lower":      {fn: mapText(strings.ToLower)},
+	"upper":      {fn: mapText(strings.ToUpper)},
+	"empty_null": {fn: emptyNull},
+	"yn_bool":    {fn: ynBool, psql: "BOOLEAN"},
+	"bool":       {fn: intBool, psql: "BOOLEAN"},
+	"json":       {fn: parseJSON, psql: "JSONB"},
+}
+
+// One transform name or a list of them, applied in order
+type transformList []string
+
+func (l *transformList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*l = transformList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("transforms should be a name or a list of names")
+	}
+	*l = many
+	return nil
+}
+
+func checkTransforms(names []string) error {
+	for _, name := range names {
+		if _, ok := transforms[name]; !ok {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return nil
+}
+
+// Text comes back from the driver as either string or []byte
+func textValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	}
+	return "", false
+}
+
+func mapText(f func(string) string) func(interface{}) (interface{}, error) {
+	return func(v interface{}) (interface{}, error) {
+		if s, ok := textValue(v); ok {
+			return f(s), nil
+		}
+		return v, nil
+	}
+}
+
+func emptyNull(v interface{}) (interface{}, error) {
+	if s, ok := textValue(v); ok && s == "" {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// 'Y' and 'N', in either case and with any padding, to a boolean
+func ynBool(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, _ := textValue(v)
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "Y":
+		return true, nil
+	case "N":
+		return false, nil
+	}
+	return nil, fmt.Errorf("%v is not Y or N", v)
+}
+
+// 0 to false and anything else to true, for flags kept in integer columns
+func intBool(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, bool:
+		return x, nil
+	case int64:
+		return x != 0, nil
+	}
+	s, _ := textValue(v)
+	switch strings.TrimSpace(s) {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return nil, fmt.Errorf("%v is not 0 or 1", v)
+}
+
+func parseJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, _ := textValue(v)
+	if !json.Valid([]byte(s)) {
+		return nil, fmt.Errorf("%q is not valid JSON", s)
+	}
+	return s, nil
+}
+
+// Set the type overrides, transforms and sync column from a table's options
+func setColumnOptions(t *Table, o TableOptions) {
+	t.Sync = o.SyncColumn
+	if t.Sync != "" && t.Column(t.Sync) == nil {
+		log.Printf("Warning: sync column %s.%s doesn't exist", t.Key(), t.Sync)
+	}
+	for name, typ := range o.Types {
+		if c := t.Column(name); c != nil {
+			c.Type = typ
+		} else {
+			log.Printf("Warning: type override for %s.%s, which doesn't exist", t.Key(), name)
+		}
+	}
+	for name, list := range o.Transforms {
+		if c := t.Column(name); c != nil {
+			c.Transforms = []string(list)
+		} else {
+			log.Printf("Warning: transform for %s.%s, which doesn't exist", t.Key(), name)
+		}
+	}
+}
+
+// Run a value through the column's transforms
+func (c *Column) transform(v interface{}) (interface{}, error) {
+	for _, name := range c.Transforms {
+		var err error
+		if v, err = transforms[name].fn(v); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", c.OriginalName, name, err)
+		}
+	}
+	return v, nil
+}
+
+// Convert a row read from SQL Server into what's written to Postgres, by
+// each column's type and then through its transforms
+func (t *Table) transformRow(row []interface{}) error {
+	for i := range t.Columns {
+		c := &t.Columns[i]
+		v, err := c.convert(row[i])
+		if err != nil {
+			return err
+		}
+		if v, err = c.transform(v); err != nil {
+			return err
+		}
+		row[i] = v
+	}
+	return nil
+}
+
+// Columns whose values are changed on the way, which verify can't compare
+func (c *Column) converted() bool {
+	return c.Type != "" || len(c.Transforms) > 0
+}
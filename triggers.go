@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Levels AFTER triggers can be converted at
+const (
+	TriggerLevelStatement = "statement" // inserted and deleted become transition tables
+	TriggerLevelRow       = "row"       // inserted and deleted become NEW and OLD
+)
+
+// A DML trigger, converted into a trigger function and the CREATE TRIGGER
+// statements that call it
+type Trigger struct {
+	Routine            // The trigger function, named after the trigger
+	On        *Table   // The table or view it's on
+	Events    []string // INSERT, UPDATE and DELETE
+	InsteadOf bool
+	Disabled  bool
+	Row       bool     // Row level rather than statement level
+	Creates   []string // CREATE TRIGGER, and ALTER TABLE when it's disabled
+}
+
+// Read the triggers on tables and views in a schema
+func getTriggers(db *sql.DB, schema string) []Trigger {
+	rows, err := db.Query(`SELECT s.name, o.name, t.name, m.definition,
+			t.is_instead_of_trigger, t.is_disabled,
+			OBJECTPROPERTY(t.object_id, 'ExecIsInsertTrigger'),
+			OBJECTPROPERTY(t.object_id, 'ExecIsUpdateTrigger'),
+			OBJECTPROPERTY(t.object_id, 'ExecIsDeleteTrigger')
+		FROM sys.triggers t
+		JOIN sys.objects o ON o.object_id = t.parent_id
+		JOIN sys.schemas s ON s.schema_id = o.schema_id
+		LEFT JOIN sys.sql_modules m ON m.object_id = t.object_id
+		WHERE t.parent_class = 1 AND t.is_ms_shipped = 0 AND s.name = ?
+		ORDER BY o.name, t.name`, schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []Trigger{}
+	defer rows.Close()
+	for rows.Next() {
+		t := Trigger{}
+		t.Type = "TR"
+		var table string
+		var def sql.NullString
+		var insert, update, delete bool
+		if err := rows.Scan(&t.OriginalSchema, &table, &t.OriginalName, &def,
+			&t.InsteadOf, &t.Disabled, &insert, &update, &delete); err != nil {
+			log.Fatal(err)
+		}
+		// Only the table's name is known until it's matched up with the
+		// tables being migrated
+		t.On = &Table{OriginalSchema: t.OriginalSchema, OriginalName: table}
+		for i, on := range []bool{insert, update, delete} {
+			if on {
+				t.Events = append(t.Events, []string{"INSERT", "UPDATE", "DELETE"}[i])
+			}
+		}
+		t.Definition = def.String
+		if !def.Valid {
+			t.Issues = append(t.Issues, "the definition is encrypted")
+		}
+		out = append(out, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// Read and convert the triggers on the tables and views being migrated
+func loadTriggers(cfg config, msDB *sql.DB, tables []Table, views []View) []Trigger {
+	if !cfg.triggers {
+		return nil
+	}
+	if cfg.triggerLevel != TriggerLevelStatement && cfg.triggerLevel != TriggerLevelRow {
+		log.Fatalf("unknown trigger level %q, expected statement or row", cfg.triggerLevel)
+	}
+	relations := map[string]*Table{}
+	schemas := []string{}
+	for i := range tables {
+		relations[strings.ToLower(tables[i].OriginalSchema+"."+tables[i].OriginalName)] = &tables[i]
+		if !containsFold(schemas, tables[i].OriginalSchema) {
+			schemas = append(schemas, tables[i].OriginalSchema)
+		}
+	}
+	for i := range views {
+		relations[strings.ToLower(views[i].OriginalSchema+"."+views[i].OriginalName)] = &views[i].Table
+		if !containsFold(schemas, views[i].OriginalSchema) {
+			schemas = append(schemas, views[i].OriginalSchema)
+		}
+	}
+
+	triggers := []Trigger{}
+	for _, schema := range schemas {
+		for _, t := range getTriggers(msDB, schema) {
+			on, ok := relations[strings.ToLower(t.On.OriginalSchema+"."+t.On.OriginalName)]
+			if !ok {
+				continue
+			}
+			t.On = on
+			t.NewSchema = on.NewSchema
+			t.NewName = cfg.namer.Name(t.OriginalName)
+			// Postgres only has INSTEAD OF triggers for each row
+			t.Row = t.InsteadOf || cfg.triggerLevel == TriggerLevelRow
+			if t.Definition != "" {
+				t.convert(relations, cfg.namer)
+			}
+			triggers = append(triggers, t)
+		}
+	}
+	return triggers
+}
+
+// Convert the trigger's body into a trigger function, with inserted and
+// deleted as NEW and OLD or as transition tables
+func (t *Trigger) convert(relations map[string]*Table, namer *Namer) {
+	pseudo := map[string]pseudoTable{
+		"inserted": {table: t.On, text: quotePsql("inserted")},
+		"deleted":  {table: t.On, text: quotePsql("deleted")},
+	}
+	if t.Row {
+		inserted, deleted := "(SELECT NEW.*)", "(SELECT OLD.*)"
+		if containsFold(t.Events, "DELETE") {
+			inserted = "(SELECT NEW.* WHERE TG_OP <> 'DELETE')"
+		}
+		if containsFold(t.Events, "INSERT") {
+			deleted = "(SELECT OLD.* WHERE TG_OP <> 'INSERT')"
+		}
+		pseudo["inserted"] = pseudoTable{table: t.On, text: inserted, row: "NEW"}
+		pseudo["deleted"] = pseudoTable{table: t.On, text: deleted, row: "OLD"}
+	}
+	tr, err := newTriggerTranslator(t.Definition, t.OriginalSchema, relations, namer, pseudo)
+	if err != nil {
+		t.Issues = append(t.Issues, err.Error())
+		return
+	}
+	tr.issues = nil
+	tr.vars = map[string]variable{}
+	rc := &routineConverter{r: &t.Routine, tr: tr, toks: tr.toks}
+
+	// CREATE TRIGGER name ON table [WITH options] {FOR|AFTER|INSTEAD OF} events
+	// [WITH APPEND] [NOT FOR REPLICATION] AS body
+	toks := tr.toks
+	i := 0
+	for i < len(toks) && !toks[i].is("for", "after", "instead") {
+		i++
+	}
+	for i < len(toks) && !toks[i].is("as") {
+		i++
+	}
+	if i >= len(toks) {
+		t.Issues = append(t.Issues, "can't find the trigger's body")
+		return
+	}
+	hi := len(toks)
+	for hi > i && (toks[hi-1].kind == tokSpace || toks[hi-1].text == ";") {
+		hi--
+	}
+	body, _ := rc.statements(nextToken(toks, i), hi, false)
+	if len(body) == 0 || body[len(body)-1] != "RETURN NULL;" {
+		body = append(body, "RETURN NULL;")
+	}
+	t.Sql = rc.function(nil, "trigger", body)
+
+	uses := map[string]bool{}
+	for j, rel := range tr.refs {
+		if _, ok := pseudo[strings.ToLower(toks[j].name())]; ok {
+			uses[strings.ToLower(toks[j].name())] = true
+		} else if rel == t.On && t.InsteadOf && t.On.Columns != nil && containsFold(t.Events, dmlEvent(toks, j)) {
+			rc.note([]string{"an INSTEAD OF trigger on a table becomes a BEFORE trigger, which fires again when it does the same to the table itself"})
+		}
+	}
+	t.Creates = t.createSql(uses)
+}
+
+// The statement changing the table named at token i, or ""
+func dmlEvent(toks []token, i int) string {
+	p := prevToken(toks, i)
+	switch {
+	case p < 0:
+	case toks[p].is("update"):
+		return "UPDATE"
+	case toks[p].is("into"):
+		if q := prevToken(toks, p); q >= 0 && toks[q].is("insert") {
+			return "INSERT"
+		}
+	case toks[p].is("from"):
+		if q := prevToken(toks, p); q >= 0 && toks[q].is("delete") {
+			return "DELETE"
+		}
+	case toks[p].is("delete"):
+		return "DELETE"
+	}
+	return ""
+}
+
+// The CREATE TRIGGER statements. Transition tables can only be used by a
+// trigger with one event, so a statement level trigger using them has one
+// per event.
+func (t *Trigger) createSql(uses map[string]bool) []string {
+	timing := "AFTER"
+	if t.InsteadOf {
+		// INSTEAD OF is only for views, a table's BEFORE trigger returning
+		// NULL skips the row instead
+		timing = "INSTEAD OF"
+		if t.On.Columns != nil {
+			timing = "BEFORE"
+		}
+	}
+	call := fmt.Sprintf("EXECUTE FUNCTION %s()", t.PsqlName())
+
+	out, names := []string{}, []string{}
+	switch {
+	case t.Row:
+		names = append(names, t.NewName)
+		out = append(out, fmt.Sprintf("CREATE TRIGGER %s %s %s ON %s\nFOR EACH ROW %s",
+			quotePsql(t.NewName), timing, strings.Join(t.Events, " OR "), t.On.PsqlName(), call))
+	case !uses["inserted"] && !uses["deleted"]:
+		names = append(names, t.NewName)
+		out = append(out, fmt.Sprintf("CREATE TRIGGER %s %s %s ON %s\nFOR EACH STATEMENT %s",
+			quotePsql(t.NewName), timing, strings.Join(t.Events, " OR "), t.On.PsqlName(), call))
+	default:
+		for _, event := range t.Events {
+			name := t.NewName
+			if len(t.Events) > 1 {
+				name += "_" + strings.ToLower(event)
+			}
+			names = append(names, name)
+			referencing := []string{}
+			if event != "DELETE" && uses["inserted"] {
+				referencing = append(referencing, "NEW TABLE AS inserted")
+			}
+			if event != "INSERT" && uses["deleted"] {
+				referencing = append(referencing, "OLD TABLE AS deleted")
+			}
+			switch {
+			case event == "INSERT" && uses["deleted"]:
+				t.Issues = append(t.Issues, "uses deleted, which a statement level INSERT trigger doesn't have, check TG_OP first")
+			case event == "DELETE" && uses["inserted"]:
+				t.Issues = append(t.Issues, "uses inserted, which a statement level DELETE trigger doesn't have, check TG_OP first")
+			}
+			stmt := fmt.Sprintf("CREATE TRIGGER %s %s %s ON %s\n", quotePsql(name), timing, event, t.On.PsqlName())
+			if len(referencing) > 0 {
+				stmt += "REFERENCING " + strings.Join(referencing, " ") + "\n"
+			}
+			out = append(out, stmt+"FOR EACH STATEMENT "+call)
+		}
+	}
+
+	if t.Disabled {
+		if t.On.Columns == nil {
+			t.Issues = append(t.Issues, "the trigger is disabled")
+			return out
+		}
+		for _, name := range names {
+			out = append(out, fmt.Sprintf("ALTER TABLE %s DISABLE TRIGGER %s", t.On.PsqlName(), quotePsql(name)))
+		}
+	}
+	return out
+}
+
+// Create the triggers that converted cleanly, after the data is loaded so
+// they don't fire for it
+func createTriggers(db *sql.DB, triggers []Trigger) {
+	for i := range triggers {
+		t := &triggers[i]
+		if len(t.Issues) > 0 {
+			log.Printf("Skipping  trigger %s: needs review", t.Key())
+			continue
+		}
+		log.Println("Createing ", t.Key())
+		for _, stmt := range t.statements() {
+			if _, err := db.Exec(stmt); err != nil {
+				log.Printf("Warning: trigger %s: %s", t.Key(), err)
+				t.Issues = append(t.Issues, err.Error())
+				break
+			}
+		}
+	}
+}
+
+// The trigger function and its triggers as statements
+func (t *Trigger) statements() []string {
+	return append([]string{t.Sql}, t.Creates...)
+}
+
+func triggerReview(triggers []Trigger) []reviewItem {
+	items := []reviewItem{}
+	for _, t := range triggers {
+		if len(t.Issues) == 0 {
+			continue
+		}
+		translated := ""
+		if t.Sql != "" {
+			translated = strings.Join(t.statements(), ";\n\n") + ";"
+		}
+		items = append(items, reviewItem{
+			Kind:       "trigger",
+			Source:     t.OriginalSchema + "." + t.OriginalName,
+			Target:     t.Key(),
+			Issues:     t.Issues,
+			Original:   t.Definition,
+			Translated: translated,
+		})
+	}
+	return items
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Largest length Postgres will accept for VARCHAR(n)/CHAR(n), anything above
+// this (including the (max) types) becomes TEXT.
+const psqlMaxCharLength = 10485760
+
+// Broad families of types, used where values need handling beyond the type name
+type valueKind int
+
+const (
+	kindOther valueKind = iota
+	kindInteger
+	kindDecimal
+	kindFloat
+	kindReal
+	kindText
+	kindTime
+	kindBool
+	kindBinary
+	kindUUID
+)
+
+// Describes how a single SQL Server type is carried over to Postgres.
+type typeMapping struct {
+	kind valueKind
+
+	// Builds the Postgres type from the sp_columns metadata
+	psql func(col *MSSqlColumn) string
+
+	// Optional expression used in place of the bare column name when
+	// selecting from SQL Server, for types the driver can't hand back in a
+	// form Postgres understands. %s is replaced by the column name.
+	selectExpr string
+
+	// Optional conversion of the values the driver returns, before any
+	// transforms, see values.go
+	convert func(col *MSSqlColumn, v interface{}) (interface{}, error)
+}
+
+func fixed(name string) func(*MSSqlColumn) string {
+	return func(*MSSqlColumn) string { return name }
+}
+
+// CHAR(n)/VARCHAR(n) using the column's PRECISION, falling back to TEXT for
+// the (max) variants.
+func sized(name string) func(*MSSqlColumn) string {
+	return func(col *MSSqlColumn) string {
+		if col.PRECISION <= 0 || col.PRECISION > psqlMaxCharLength {
+			return "TEXT"
+		}
+		return fmt.Sprintf("%s(%d)", name, col.PRECISION)
+	}
+}
+
+func numeric(col *MSSqlColumn) string {
+	return fmt.Sprintf("NUMERIC(%d,%d)", col.PRECISION, col.SCALE)
+}
+
+// Postgres only goes down to microseconds, SQL Server goes to 100ns
+func fractional(name string) func(*MSSqlColumn) string {
+	return func(col *MSSqlColumn) string {
+		scale := col.SCALE
+		if scale > 6 {
+			scale = 6
+		}
+		return fmt.Sprintf("%s(%d)", name, scale)
+	}
+}
+
+func float(col *MSSqlColumn) string {
+	if col.PRECISION > 0 && col.PRECISION <= 7 {
+		return "REAL"
+	}
+	return "DOUBLE PRECISION"
+}
+
+// Every type SQL Server ships with, keyed by the TYPE_NAME from sp_columns.
+//
+// Help: http://www.sqlines.com/sql-server-to-postgresql
+var typeMap = map[string]typeMapping{
+	"bigint":   {kind: kindInteger, psql: fixed("BIGINT")},
+	"int":      {kind: kindInteger, psql: fixed("INT")},
+	"smallint": {kind: kindInteger, psql: fixed("SMALLINT")},
+	"tinyint":  {kind: kindInteger, psql: fixed("SMALLINT")},
+	"bit":      {kind: kindBool, psql: fixed("BOOL")},
+
+	"decimal":    {kind: kindDecimal, psql: numeric, convert: decimalValue},
+	"numeric":    {kind: kindDecimal, psql: numeric, convert: decimalValue},
+	"money":      {kind: kindDecimal, psql: fixed("NUMERIC(19,4)"), convert: moneyValue},
+	"smallmoney": {kind: kindDecimal, psql: fixed("NUMERIC(10,4)"), convert: moneyValue},
+	"float":      {kind: kindFloat, psql: float, convert: floatValue},
+	"real":       {kind: kindReal, psql: fixed("REAL"), convert: realValue},
+
+	"date":           {kind: kindTime, psql: fixed("DATE")},
+	"time":           {kind: kindTime, psql: fractional("TIME")},
+	"smalldatetime":  {kind: kindTime, psql: fixed("TIMESTAMP(0)")},
+	"datetime":       {kind: kindTime, psql: fixed("TIMESTAMP(3)")},
+	"datetime2":      {kind: kindTime, psql: fractional("TIMESTAMP")},
+	"datetimeoffset": {kind: kindTime, psql: fractional("TIMESTAMPTZ")},
+
+	"char":     {kind: kindText, psql: sized("CHAR")},
+	"nchar":    {kind: kindText, psql: sized("CHAR")},
+	"varchar":  {kind: kindText, psql: sized("VARCHAR")},
+	"nvarchar": {kind: kindText, psql: sized("VARCHAR")},
+	"sysname":  {kind: kindText, psql: fixed("VARCHAR(128)")},
+	"text":     {kind: kindText, psql: fixed("TEXT")},
+	"ntext":    {kind: kindText, psql: fixed("TEXT")},
+
+	"binary":     {kind: kindBinary, psql: fixed("BYTEA")},
+	"varbinary":  {kind: kindBinary, psql: fixed("BYTEA")},
+	"image":      {kind: kindBinary, psql: fixed("BYTEA")},
+	"timestamp":  {kind: kindBinary, psql: fixed("BYTEA")},
+	"rowversion": {kind: kindBinary, psql: fixed("BYTEA")},
+
+	"uniqueidentifier": {kind: kindUUID, psql: fixed("UUID"), selectExpr: "CAST(%s AS CHAR(36))"},
+	"xml":              {psql: fixed("XML"), selectExpr: "CAST(%s AS NVARCHAR(MAX))"},
+	"sql_variant":      {psql: fixed("TEXT"), selectExpr: "CAST(%s AS NVARCHAR(4000))"},
+	"hierarchyid":      {psql: fixed("TEXT"), selectExpr: "%s.ToString()"},
+	"geography":        {psql: fixed("TEXT"), selectExpr: "%s.STAsText()"},
+	"geometry":         {psql: fixed("TEXT"), selectExpr: "%s.STAsText()"},
+}
+
+// The legacy SS_DATA_TYPE codes, used for alias (user defined) types where the
+// TYPE_NAME is the alias rather than the underlying type.
+var ssDataTypeMap = map[int]string{
+	34:  "image",
+	35:  "text",
+	37:  "varbinary",
+	39:  "varchar",
+	45:  "binary",
+	47:  "char",
+	48:  "tinyint",
+	50:  "bit",
+	52:  "smallint",
+	55:  "decimal",
+	56:  "int",
+	58:  "smalldatetime",
+	59:  "real",
+	60:  "money",
+	61:  "datetime",
+	62:  "float",
+	63:  "numeric",
+	106: "decimal",
+	108: "numeric",
+	109: "float",
+	110: "money",
+	111: "datetime",
+	122: "smallmoney",
+}
+
+// The TYPE_NAME with any trailing " identity" removed
+func (col *MSSqlColumn) BaseTypeName() string {
+	return strings.TrimSuffix(strings.ToLower(col.TYPE_NAME), " identity")
+}
+
+func (c *Column) kind() valueKind {
+	m, _ := lookupType(c.col)
+	return m.kind
+}
+
+// Find the mapping for a column, first by name and then by SS_DATA_TYPE
+func lookupType(col *MSSqlColumn) (typeMapping, error) {
+	if m, ok := typeMap[col.BaseTypeName()]; ok {
+		return m, nil
+	}
+	if name, ok := ssDataTypeMap[col.SS_DATA_TYPE]; ok {
+		return typeMap[name], nil
+	}
+	// intn covers every integer width, go by the byte length instead
+	if col.SS_DATA_TYPE == 38 {
+		switch col.LENGTH {
+		case 1:
+			return typeMap["tinyint"], nil
+		case 2:
+			return typeMap["smallint"], nil
+		case 8:
+			return typeMap["bigint"], nil
+		}
+		return typeMap["int"], nil
+	}
+	return typeMapping{}, fmt.Errorf("%s.%s: don't know how to translate type %s (%d)",
+		col.TABLE_NAME, col.COLUMN_NAME, col.TYPE_NAME, col.DATA_TYPE)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A decimal as SQL Server or a JSON change set writes it
+var decimalText = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?$`)
+
+// Convert a value as the driver returns it into what's written to Postgres,
+// going by the column's type in SQL Server
+func (c *Column) convert(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, err := lookupType(c.col)
+	if err != nil || m.convert == nil {
+		return v, nil
+	}
+	if v, err = m.convert(c.col, v); err != nil {
+		return nil, fmt.Errorf("%s: %s", c.OriginalName, err)
+	}
+	return v, nil
+}
+
+// Decimals come back as text, which is passed on as it is so no digits are
+// lost to floating point. Anything past the column's scale would be rounded
+// away by Postgres, so is an error instead.
+func decimalValue(col *MSSqlColumn, v interface{}) (interface{}, error) {
+	return exactDecimal(v, col.SCALE)
+}
+
+// money and smallmoney always have 4 decimal places, like NUMERIC(19,4)
+func moneyValue(col *MSSqlColumn, v interface{}) (interface{}, error) {
+	return exactDecimal(v, 4)
+}
+
+func exactDecimal(v interface{}, scale int) (string, error) {
+	var s string
+	switch x := v.(type) {
+	case []byte:
+		s = string(x)
+	case string:
+		s = x
+	case json.Number:
+		s = string(x)
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case float64:
+		// Only from a change set written without quotes, the shortest text
+		// that reads back as the same float64
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return "", fmt.Errorf("%v isn't a decimal", x)
+		}
+		s = strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		return "", fmt.Errorf("unexpected %T for a decimal", v)
+	}
+	s = strings.TrimSpace(s)
+	if !decimalText.MatchString(s) {
+		return "", fmt.Errorf("%q isn't a decimal", s)
+	}
+	if strings.ContainsAny(s, "eE") {
+		return s, nil
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		if extra := strings.TrimRight(s[i+1:], "0"); len(extra) > scale {
+			return "", fmt.Errorf("%s has more than %d decimal places", s, scale)
+		}
+	}
+	return s, nil
+}
+
+// float and real are written as the shortest text that reads back as the
+// same value, so nothing is lost in either direction. Columns that are REAL
+// in Postgres are formatted as float32, otherwise the float64 the driver
+// widened them to shows digits that were never there.
+func floatValue(col *MSSqlColumn, v interface{}) (interface{}, error) {
+	if float(col) == "REAL" {
+		return shortestFloat(v, 32)
+	}
+	return shortestFloat(v, 64)
+}
+
+func realValue(col *MSSqlColumn, v interface{}) (interface{}, error) {
+	return shortestFloat(v, 32)
+}
+
+func shortestFloat(v interface{}, bits int) (interface{}, error) {
+	var f float64
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case float32:
+		f = float64(x)
+	case int64:
+		f = float64(x)
+	case json.Number:
+		return shortestFloat(string(x), bits)
+	default:
+		s, ok := textValue(v)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T for a float", v)
+		}
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(s), bits); err != nil {
+			return nil, fmt.Errorf("%q isn't a number", s)
+		}
+	}
+
+	switch {
+	case math.IsNaN(f):
+		return "NaN", nil
+	case math.IsInf(f, 1):
+		return "Infinity", nil
+	case math.IsInf(f, -1):
+		return "-Infinity", nil
+	}
+	return strconv.FormatFloat(f, 'g', -1, bits), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestConvertDecimal(t *testing.T) {
+	tests := []struct {
+		typ              string
+		precision, scale int
+		in               interface{}
+		want             string
+		fails            bool
+	}{
+		{"numeric", 38, 0, []byte("99999999999999999999999999999999999999"), "99999999999999999999999999999999999999", false},
+		{"numeric", 38, 0, []byte("-99999999999999999999999999999999999999"), "-99999999999999999999999999999999999999", false},
+		{"numeric", 38, 38, []byte("0.99999999999999999999999999999999999999"), "0.99999999999999999999999999999999999999", false},
+		{"numeric", 38, 38, []byte("-0.00000000000000000000000000000000000001"), "-0.00000000000000000000000000000000000001", false},
+		{"decimal", 10, 2, []byte("12.3400"), "12.3400", false},
+		{"decimal", 10, 2, "12.345", "", true},
+		{"numeric", 38, 0, []byte("1.5"), "", true},
+		{"numeric", 38, 37, []byte("0.99999999999999999999999999999999999999"), "", true},
+		{"decimal", 10, 2, "abc", "", true},
+
+		{"money", 19, 4, []byte("-922337203685477.5808"), "-922337203685477.5808", false},
+		{"money", 19, 4, []byte("922337203685477.5807"), "922337203685477.5807", false},
+		{"smallmoney", 10, 4, []byte("-214748.3648"), "-214748.3648", false},
+		{"smallmoney", 10, 4, []byte("214748.3647"), "214748.3647", false},
+		{"money", 19, 4, "0.00001", "", true},
+	}
+	for _, test := range tests {
+		c := testColumn("v", test.typ, test.precision, test.scale)
+		got, err := c.convert(test.in)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s(%d,%d) %s: got %v, want an error", test.typ, test.precision, test.scale, test.in, got)
+		case !test.fails && err != nil:
+			t.Errorf("%s(%d,%d) %s: %s", test.typ, test.precision, test.scale, test.in, err)
+		case !test.fails && got != test.want:
+			t.Errorf("%s(%d,%d) %s: got %v, want %s", test.typ, test.precision, test.scale, test.in, got, test.want)
+		}
+	}
+}
+
+func TestConvertFloat(t *testing.T) {
+	tests := []struct {
+		typ       string
+		precision int
+		in        interface{}
+		want      string
+	}{
+		{"float", 53, 0.1, "0.1"},
+		{"float", 53, math.MaxFloat64, "1.7976931348623157e+308"},
+		{"float", 53, -math.MaxFloat64, "-1.7976931348623157e+308"},
+		{"float", 53, math.SmallestNonzeroFloat64, "5e-324"},
+		{"float", 53, math.Copysign(0, -1), "-0"},
+		{"float", 53, []byte("2.2250738585072014e-308"), "2.2250738585072014e-308"},
+
+		// The driver widens real to float64
+		{"real", 24, float64(float32(0.1)), "0.1"},
+		{"real", 24, float32(0.1), "0.1"},
+		{"real", 24, float64(float32(math.MaxFloat32)), "3.4028235e+38"},
+		{"real", 24, float64(float32(math.SmallestNonzeroFloat32)), "1e-45"},
+		{"float", 24, float64(float32(16777216)), "1.6777216e+07"},
+
+		{"float", 53, math.NaN(), "NaN"},
+		{"float", 53, math.Inf(1), "Infinity"},
+		{"float", 53, math.Inf(-1), "-Infinity"},
+		{"real", 24, float32(math.Inf(1)), "Infinity"},
+		{"real", 24, float32(math.Inf(-1)), "-Infinity"},
+		{"real", 24, math.NaN(), "NaN"},
+	}
+	for _, test := range tests {
+		c := testColumn("v", test.typ, test.precision, 0)
+		got, err := c.convert(test.in)
+		if err != nil {
+			t.Errorf("%s(%d) %v: %s", test.typ, test.precision, test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s(%d) %v: got %v, want %s", test.typ, test.precision, test.in, got, test.want)
+		}
+	}
+}
+
+// Every finite value reads back as exactly the value that was written
+func TestConvertFloatRoundTrip(t *testing.T) {
+	double := testColumn("v", "float", 53, 0)
+	for _, f := range []float64{0.1, 1.0 / 3, math.Pi, math.MaxFloat64, math.SmallestNonzeroFloat64, 2.2250738585072014e-308, 1e23} {
+		got, err := double.convert(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back, err := strconv.ParseFloat(got.(string), 64); err != nil || back != f {
+			t.Errorf("%v: %v reads back as %v", f, got, back)
+		}
+	}
+	single := testColumn("v", "real", 24, 0)
+	for _, f := range []float32{0.1, 1.0 / 3, math.MaxFloat32, math.SmallestNonzeroFloat32, 1.17549435e-38} {
+		got, err := single.convert(float64(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back, err := strconv.ParseFloat(got.(string), 32); err != nil || float32(back) != f {
+			t.Errorf("%v: %v reads back as %v", f, got, back)
+		}
+	}
+}
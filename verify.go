@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// One line of the verification report
+type verifyResult struct {
+	Table  string
+	Check  string
+	Source string
+	Target string
+	OK     bool
+}
+
+// An aggregate run over the same column on both sides
+type aggregate struct {
+	name   string
+	mssql  string
+	psql   string
+	approx bool // Floating point sums can differ in the last few digits
+}
+
+// The aggregates compared for a column, every column gets a null count and
+// the rest depends on its type. Types pulled through a select expression
+// (xml, spatial etc) only get the null count, and columns with a type
+// override or transforms aren't compared at all.
+func (c *Column) aggregates() []aggregate {
+	if c.converted() {
+		return nil
+	}
+	o, n := c.MSSqlName(), c.PsqlName()
+	aggs := []aggregate{{
+		name:  "nulls",
+		mssql: fmt.Sprintf("COUNT_BIG(*) - COUNT_BIG(%s)", o),
+		psql:  fmt.Sprintf("COUNT(*) - COUNT(%s)", n),
+	}}
+	minMax := []aggregate{
+		{name: "min", mssql: fmt.Sprintf("MIN(%s)", o), psql: fmt.Sprintf("MIN(%s)", n)},
+		{name: "max", mssql: fmt.Sprintf("MAX(%s)", o), psql: fmt.Sprintf("MAX(%s)", n)},
+	}
+
+	switch c.kind() {
+	case kindInteger:
+		aggs = append(aggs, minMax...)
+		aggs = append(aggs, aggregate{name: "sum",
+			mssql: fmt.Sprintf("SUM(CAST(%s AS DECIMAL(38,0)))", o),
+			psql:  fmt.Sprintf("SUM(%s)", n)})
+	case kindDecimal:
+		aggs = append(aggs, minMax...)
+		aggs = append(aggs, aggregate{name: "sum",
+			mssql: fmt.Sprintf("SUM(%s)", o),
+			psql:  fmt.Sprintf("SUM(%s)", n)})
+	case kindFloat, kindReal:
+		aggs = append(aggs, minMax...)
+		aggs = append(aggs, aggregate{name: "sum", approx: true,
+			mssql: fmt.Sprintf("SUM(CAST(%s AS FLOAT))", o),
+			psql:  fmt.Sprintf("SUM(%s::DOUBLE PRECISION)", n)})
+	case kindTime:
+		aggs = append(aggs, minMax...)
+	case kindBool:
+		aggs = append(aggs, aggregate{name: "true",
+			mssql: fmt.Sprintf("SUM(CAST(%s AS BIGINT))", o),
+			psql:  fmt.Sprintf("SUM(%s::INT)", n)})
+	case kindText:
+		// LEN ignores trailing spaces, so trim them on the Postgres side too
+		aggs = append(aggs, aggregate{name: "length",
+			mssql: fmt.Sprintf("SUM(CAST(LEN(CAST(%s AS NVARCHAR(MAX))) AS BIGINT))", o),
+			psql:  fmt.Sprintf("SUM(length(rtrim(%s)))", n)})
+	}
+	return aggs
+}
+
+// Verify the tables were copied faithfully. Returns false if anything
+// differs. With hash set the rows themselves are compared chunk by chunk, and
+// chunks that differ are narrowed down to the rows that don't match.
+func verify(cfg config, msDB, psqlDB *sql.DB, tables []Table, out io.Writer) bool {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tCHECK\tSOURCE\tTARGET\t")
+	ok := true
+
+	for _, t := range tables {
+		log.Println("Verifying ", t.Key())
+		results, err := compareAggregates(msDB, psqlDB, t)
+		if err != nil {
+			results = append(results, verifyResult{Table: t.Key(), Check: "aggregates", Source: err.Error()})
+		}
+
+		if cfg.hash && err == nil {
+			hashResults, err := compareChunks(msDB, psqlDB, t, cfg.chunkRows, cfg.maxDiffs)
+			if err != nil {
+				hashResults = append(hashResults, verifyResult{Table: t.Key(), Check: "hash", Source: err.Error()})
+			}
+			results = append(results, hashResults...)
+		}
+
+		for _, r := range results {
+			status := "ok"
+			if !r.OK {
+				status = "MISMATCH"
+				ok = false
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Table, r.Check, r.Source, r.Target, status)
+		}
+	}
+	tw.Flush()
+	return ok
+}
+
+// Compare the row count and every column aggregate in one query per side
+func compareAggregates(msDB, psqlDB *sql.DB, t Table) ([]verifyResult, error) {
+	checks := []string{"rows"}
+	msExprs := []string{"COUNT_BIG(*)"}
+	pgExprs := []string{"COUNT(*)"}
+	approx := []bool{false}
+	cols := []*Column{nil}
+	for i := range t.Columns {
+		c := &t.Columns[i]
+		for _, a := range c.aggregates() {
+			checks = append(checks, c.NewName+" "+a.name)
+			msExprs = append(msExprs, a.mssql)
+			pgExprs = append(pgExprs, a.psql)
+			approx = append(approx, a.approx)
+			cols = append(cols, c)
+		}
+	}
+
+	msVals, err := queryRow(msDB, fmt.Sprintf("SELECT %s FROM %s", strings.Join(msExprs, ", "), t.MSSqlFrom()))
+	if err != nil {
+		return nil, err
+	}
+	pgVals, err := queryRow(psqlDB, fmt.Sprintf("SELECT %s FROM %s", strings.Join(pgExprs, ", "), t.PsqlName()))
+	if err != nil {
+		return nil, err
+	}
+
+	results := []verifyResult{}
+	for i, check := range checks {
+		// Counts and sums come back as plain numbers, whatever the column
+		kind := kindDecimal
+		if cols[i] != nil && (strings.HasSuffix(check, " min") || strings.HasSuffix(check, " max")) {
+			kind = cols[i].kind()
+		}
+		src := normalizeValue(kind, msVals[i])
+		dst := normalizeValue(kind, pgVals[i])
+		match := src == dst
+		if !match && approx[i] {
+			match = closeEnough(src, dst)
+		}
+		results = append(results, verifyResult{Table: t.Key(), Check: check, Source: src, Target: dst, OK: match})
+	}
+	return results, nil
+}
+
+func queryRow(db *sql.DB, query string) ([]interface{}, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if !rows.Next() {
+		return nil, fmt.Errorf("no rows from %s", query)
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	return vals, rows.Err()
+}
+
+func closeEnough(a, b string) bool {
+	x, err1 := strconv.ParseFloat(a, 64)
+	y, err2 := strconv.ParseFloat(b, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return math.Abs(x-y) <= 1e-9*math.Max(math.Abs(x), math.Abs(y))
+}
+
+// Hash the rows of each chunk on both sides, rows in chunks that don't match
+// are compared one at a time. Needs a single integer primary key to order and
+// chunk by.
+func compareChunks(msDB, psqlDB *sql.DB, t Table, chunkRows int64, maxDiffs int) ([]verifyResult, error) {
+	col := t.ChunkColumn()
+	if col == nil {
+		return []verifyResult{{Table: t.Key(), Check: "hash", Source: "skipped, no integer primary key", OK: true}}, nil
+	}
+
+	results := []verifyResult{}
+	mismatched := 0
+	for _, cs := range planChunks(msDB, t, col, chunkRows) {
+		c := &Chunk{Column: col, Lo: cs.Lo, Hi: cs.Hi, First: cs.First, Last: cs.Last}
+		src, err := hashRows(msDB, t, t.SelectMSSqlChunk(c))
+		if err != nil {
+			return results, err
+		}
+		dst, err := hashRows(psqlDB, t, t.SelectPsqlChunk(c))
+		if err != nil {
+			return results, err
+		}
+		if src == dst {
+			continue
+		}
+
+		mismatched++
+		results = append(results, verifyResult{Table: t.Key(), Check: "hash " + c.String(), Source: src[:12], Target: dst[:12]})
+		diffs, err := diffRows(msDB, psqlDB, t, c, maxDiffs)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, diffs...)
+	}
+	if mismatched == 0 {
+		results = append(results, verifyResult{Table: t.Key(), Check: "hash", Source: "all chunks match", OK: true})
+	}
+	return results, nil
+}
+
+func hashRows(db *sql.DB, t Table, query string) (string, error) {
+	h := sha1.New()
+	err := eachRow(db, t, query, func(row []string) error {
+		io.WriteString(h, strings.Join(row, "\x1f"))
+		io.WriteString(h, "\x1e")
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// Run query and hand each row to fn with its values normalized
+func eachRow(db *sql.DB, t Table, query string, fn func(row []string) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rr := make([]interface{}, len(t.Columns))
+	ra := make([]interface{}, len(t.Columns))
+	for i := range ra {
+		ra[i] = &rr[i]
+	}
+	kinds := make([]valueKind, len(t.Columns))
+	for i := range t.Columns {
+		kinds[i] = t.Columns[i].kind()
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(ra...); err != nil {
+			return err
+		}
+		row := make([]string, len(rr))
+		for i, v := range rr {
+			if !t.Columns[i].converted() {
+				row[i] = normalizeValue(kinds[i], v)
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Walk both sides of a chunk in key order reporting rows that are missing,
+// extra or different, up to maxDiffs of them.
+func diffRows(msDB, psqlDB *sql.DB, t Table, c *Chunk, maxDiffs int) ([]verifyResult, error) {
+	keyIdx := 0
+	for i := range t.Columns {
+		if t.Columns[i].OriginalName == c.Column.OriginalName {
+			keyIdx = i
+		}
+	}
+
+	src, err := readRows(msDB, t, t.SelectMSSqlChunk(c))
+	if err != nil {
+		return nil, err
+	}
+	dst, err := readRows(psqlDB, t, t.SelectPsqlChunk(c))
+	if err != nil {
+		return nil, err
+	}
+
+	results := []verifyResult{}
+	add := func(key, check, s, d string) bool {
+		results = append(results, verifyResult{Table: t.Key(), Check: fmt.Sprintf("row %s=%s %s", c.Column.NewName, key, check), Source: s, Target: d})
+		return len(results) < maxDiffs
+	}
+
+	i, j := 0, 0
+	for i < len(src) || j < len(dst) {
+		var sk, dk int64
+		if i < len(src) {
+			sk, _ = strconv.ParseInt(src[i][keyIdx], 10, 64)
+		}
+		if j < len(dst) {
+			dk, _ = strconv.ParseInt(dst[j][keyIdx], 10, 64)
+		}
+
+		switch {
+		case j >= len(dst) || (i < len(src) && sk < dk):
+			if !add(src[i][keyIdx], "missing", "present", "") {
+				return results, nil
+			}
+			i++
+		case i >= len(src) || dk < sk:
+			if !add(dst[j][keyIdx], "extra", "", "present") {
+				return results, nil
+			}
+			j++
+		default:
+			for k := range t.Columns {
+				if src[i][k] != dst[j][k] {
+					if !add(src[i][keyIdx], t.Columns[k].NewName, src[i][k], dst[j][k]) {
+						return results, nil
+					}
+				}
+			}
+			i++
+			j++
+		}
+	}
+	return results, nil
+}
+
+func readRows(db *sql.DB, t Table, query string) ([][]string, error) {
+	out := [][]string{}
+	err := eachRow(db, t, query, func(row []string) error {
+		out = append(out, row)
+		return nil
+	})
+	return out, err
+}
+
+// Render a value from either driver in the same form, so values that mean
+// the same thing compare equal.
+func normalizeValue(kind valueKind, v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+
+	switch kind {
+	case kindReal:
+		// REAL goes through float64 on one side and float32 on the other
+		if f, ok := v.(float64); ok {
+			return strconv.FormatFloat(float64(float32(f)), 'g', -1, 32)
+		}
+	case kindBinary:
+		if b, ok := v.([]byte); ok {
+			return hex.EncodeToString(b)
+		}
+	case kindUUID:
+		return strings.ToLower(fmt.Sprintf("%s", v))
+	}
+
+	switch x := v.(type) {
+	case []byte:
+		return normalizeText(kind, string(x))
+	case string:
+		return normalizeText(kind, x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case time.Time:
+		// Postgres keeps microseconds, SQL Server goes down to 100ns. TIME
+		// values come back on day 1 from SQL Server and day 0 from Postgres.
+		x = x.UTC().Round(time.Microsecond)
+		if x.Year() <= 1 {
+			return x.Format("15:04:05.999999")
+		}
+		return x.Format("2006-01-02 15:04:05.999999")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Decimals come back as text with a varying number of trailing zeros
+func normalizeText(kind valueKind, s string) string {
+	if kind == kindDecimal && strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		if s == "" || s == "-" {
+			s = "0"
+		}
+	}
+	return s
+}
+
+func runVerify(cfg config, msDB *sql.DB, tables []Table) {
+	psqlDB := ConnectAndTest("postgres", cfg.to)
+	if !verify(cfg, msDB, psqlDB, tables, os.Stdout) {
+		os.Exit(1)
+	}
+}
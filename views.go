@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A view and its translation into Postgres
+type View struct {
+	Table             // Only the names are used
+	Definition string // The CREATE VIEW from sys.sql_modules
+	Sql        string // The Postgres CREATE VIEW
+	Issues     []string
+	depends    []string // Keys of the views it selects from
+}
+
+// Read the views in a schema, with the same include and exclude patterns as
+// the tables
+func getViews(db *sql.DB, schema string, include, exclude []string) []View {
+	rows, err := db.Query(`SELECT s.name, v.name, m.definition
+		FROM sys.views v
+		JOIN sys.schemas s ON s.schema_id = v.schema_id
+		LEFT JOIN sys.sql_modules m ON m.object_id = v.object_id
+		WHERE s.name = ?
+		ORDER BY v.name`, schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := []View{}
+	defer rows.Close()
+	for rows.Next() {
+		v := View{}
+		var def sql.NullString
+		if err := rows.Scan(&v.OriginalSchema, &v.OriginalName, &def); err != nil {
+			log.Fatal(err)
+		}
+		name := tableName{Schema: v.OriginalSchema, Name: v.OriginalName}
+		if len(filterTables([]tableName{name}, include, exclude)) == 0 {
+			continue
+		}
+		v.Definition = def.String
+		if !def.Valid {
+			v.Issues = append(v.Issues, "the definition is encrypted")
+		}
+		out = append(out, v)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// Read and translate the views in the schemas the tables come from, in the
+// order they can be created in
+func loadViews(cfg config, msDB *sql.DB, tables []Table) []View {
+	if !cfg.views {
+		return nil
+	}
+	schemas := []string{cfg.schema}
+	for _, t := range tables {
+		if !containsFold(schemas, t.OriginalSchema) {
+			schemas = append(schemas, t.OriginalSchema)
+		}
+	}
+	views := []View{}
+	for _, schema := range schemas {
+		views = append(views, getViews(msDB, schema, cfg.include, cfg.exclude)...)
+	}
+	for i := range views {
+		v := &views[i]
+		v.NewSchema = cfg.schemaMap.Target(v.OriginalSchema, cfg.namer.Name)
+		cfg.namer.Rename(&v.Table)
+	}
+	translateViews(views, tables, cfg.namer)
+	return sortViews(views)
+}
+
+func translateViews(views []View, tables []Table, namer *Namer) {
+	relations := map[string]*Table{}
+	for i := range tables {
+		t := &tables[i]
+		relations[strings.ToLower(t.OriginalSchema+"."+t.OriginalName)] = t
+	}
+	for i := range views {
+		v := &views[i]
+		key := strings.ToLower(v.OriginalSchema + "." + v.OriginalName)
+		if _, ok := relations[key]; ok {
+			v.Issues = append(v.Issues, "a table of the same name is being migrated")
+			continue
+		}
+		relations[key] = &v.Table
+	}
+	for i := range views {
+		if views[i].Definition != "" {
+			views[i].translate(relations, namer)
+		}
+	}
+}
+
+// Translate the view's definition, noting anything that couldn't be
+func (v *View) translate(relations map[string]*Table, namer *Namer) {
+	tr, err := newQueryTranslator(v.Definition, v.OriginalSchema, relations, namer)
+	if err != nil {
+		v.Issues = append(v.Issues, err.Error())
+		return
+	}
+
+	// CREATE VIEW name [(columns)] [WITH options] AS query
+	toks := tr.toks
+	i := 0
+	for i < len(toks) && !toks[i].is("view") {
+		i++
+	}
+	i = nextToken(toks, i)
+	if i < 0 {
+		v.Issues = append(v.Issues, "can't find the view's name")
+		return
+	}
+	_, i = dottedName(toks, i)
+	columns := ""
+	if j := nextToken(toks, i); j >= 0 && toks[j].kind == tokLParen {
+		i = matchParen(toks, j)
+		columns = " " + tr.translate(j, i+1)
+	}
+	for i >= 0 && !toks[i].is("as") {
+		i = nextToken(toks, i)
+	}
+	if i < 0 {
+		v.Issues = append(v.Issues, "can't find the view's query")
+		return
+	}
+	hi := len(toks)
+	for hi > i && (toks[hi-1].kind == tokSpace || toks[hi-1].text == ";") {
+		hi--
+	}
+
+	query := strings.TrimSpace(tr.translate(i+1, hi))
+	v.Sql = fmt.Sprintf("CREATE OR REPLACE VIEW %s%s AS\n%s", v.PsqlName(), columns, query)
+	v.Issues = append(v.Issues, tr.issues...)
+	for _, rel := range tr.refs {
+		if rel != nil && rel.Columns == nil {
+			v.depends = append(v.depends, rel.Key())
+		}
+	}
+}
+
+// Order views so each comes after the views it selects from. Views that
+// depend on a view needing review need reviewing too.
+func sortViews(views []View) []View {
+	index := map[string]int{}
+	for i, v := range views {
+		index[v.Key()] = i
+	}
+	done := make([]bool, len(views))
+	out := make([]View, 0, len(views))
+
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] {
+			return
+		}
+		done[i] = true
+		for _, key := range views[i].depends {
+			j, ok := index[key]
+			if !ok {
+				continue
+			}
+			visit(j)
+			if len(views[j].Issues) > 0 {
+				views[i].Issues = append(views[i].Issues, fmt.Sprintf("selects from view %s, which needs review", key))
+			}
+		}
+		out = append(out, views[i])
+	}
+	for i := range views {
+		visit(i)
+	}
+	return out
+}
+
+// Create the views that translated cleanly. Ones Postgres rejects are
+// added to the review with its error.
+func createViews(db *sql.DB, views []View) {
+	for i := range views {
+		v := &views[i]
+		if len(v.Issues) > 0 {
+			log.Printf("Skipping  view %s: needs review", v.Key())
+			continue
+		}
+		log.Println("Createing ", v.Key())
+		if _, err := db.Exec(v.Sql); err != nil {
+			log.Printf("Warning: view %s: %s", v.Key(), err)
+			v.Issues = append(v.Issues, err.Error())
+		}
+	}
+}
+
+func viewReview(views []View) []reviewItem {
+	items := []reviewItem{}
+	for _, v := range views {
+		if len(v.Issues) == 0 {
+			continue
+		}
+		items = append(items, reviewItem{
+			Kind:       "view",
+			Source:     v.OriginalSchema + "." + v.OriginalName,
+			Target:     v.Key(),
+			Issues:     v.Issues,
+			Original:   v.Definition,
+			Translated: v.Sql,
+		})
+	}
+	return items
+}
+
+// Write whatever needs reviewing to the --report file
+func reportReview(cfg config, items []reviewItem) {
+	if len(items) == 0 {
+		return
+	}
+	if err := writeReview(cfg.report, items); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d objects need reviewing, see %s", len(items), cfg.report)
+}